@@ -1,64 +1,363 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 
+	"github.com/jesseduffield/horcrux/pkg/cli"
 	"github.com/jesseduffield/horcrux/pkg/commands"
 )
 
 func main() {
-	// I'd use `flaggy` but I like the idea of this repo having no dependencies
-	// Unfortunately that means I'm awkwardly making use of the standard flag package
-	if len(os.Args) < 2 {
-		usage()
+	// I'd use `flaggy` but I like the idea of this repo having no dependencies,
+	// so we get by with a little framework on top of the standard flag package
+	app := &cli.App{
+		Name: "horcrux",
+		Commands: []*cli.Command{
+			splitCommand(),
+			bindCommand(),
+			verifyCommand(),
+			statusCommand(),
+			inspectCommand(),
+			upgradeCommand(),
+		},
+		Examples: []string{
+			"horcrux split -t 3 -n 5 diary.txt",
+			"horcrux bind",
+		},
+		ExitCode: exitCode,
 	}
 
-	if os.Args[1] == "bind" {
-		var dir string
-		if len(os.Args) == 2 {
-			dir = "."
-		} else {
-			dir = os.Args[2]
-		}
-		paths, err := commands.GetHorcruxPathsInDir(dir)
-		if err != nil {
-			log.Fatal(err)
-		}
-		overwrite := false
-		for {
-			if err := commands.Bind(paths, "", overwrite); err != nil {
-				if err != os.ErrExist {
-					log.Fatal(err)
+	os.Exit(app.Run(os.Args[1:]))
+}
+
+// Exit codes, on top of the ones every command has (0 for success, 1 for any
+// other failure and 2 for bad arguments). Scripts rely on these, so never
+// change what they mean. They're documented in the README.
+const (
+	exitNotEnoughHorcruxes = 3
+	exitIntegrityFailure   = 4
+	exitDestinationExists  = 5
+)
+
+func exitCode(err error) int {
+	var notEnoughErr *commands.NotEnoughHorcruxesError
+	switch {
+	case errors.Is(err, commands.ErrDestinationExists):
+		return exitDestinationExists
+	case commands.IsIntegrityError(err):
+		return exitIntegrityFailure
+	case errors.As(err, &notEnoughErr) || errors.Is(err, commands.ErrSetsIncomplete):
+		return exitNotEnoughHorcruxes
+	}
+	return cli.ExitFailure
+}
+
+// canPrompt tells us whether we can ask the user questions
+func canPrompt(nonInteractive bool) bool {
+	return !nonInteractive && commands.StdinIsTerminal()
+}
+
+// addNonInteractiveFlag adds the flag for never reading from stdin
+func addNonInteractiveFlag(flags *flag.FlagSet, nonInteractive *bool) {
+	flags.BoolVar(nonInteractive, "non-interactive", false, "never ask any questions (this is implied when stdin isn't a terminal)")
+}
+
+func splitCommand() *cli.Command {
+	var name, outputDir string
+	var nonInteractive bool
+	options := commands.SplitOptions{}
+
+	return &cli.Command{
+		Name:    "split",
+		Args:    "<filename | directory | ->",
+		Summary: "split a file or directory into horcruxes",
+		Description: "Split a file into horcruxes, some number of which are required to bind it\n" +
+			"again. You'll be asked for -n and -t if you don't pass them. A directory is\n" +
+			"split along with everything in it, and binding recreates it. To split\n" +
+			"whatever is piped into horcrux, pass - as the filename, along with -name.",
+		SetFlags: func(flags *flag.FlagSet) {
+			flags.IntVar(&options.Total, "n", 0, "number of horcruxes to make")
+			flags.IntVar(&options.Threshold, "t", 0, "number of horcruxes required to resurrect the original file")
+			flags.BoolVar(&options.FullCopy, "full-copy", false, "store a full copy of the encrypted file in every horcrux rather than erasure coding it between them")
+			flags.StringVar(&name, "name", "", "the name to give the original file when splitting stdin")
+			flags.StringVar(&outputDir, "output-dir", "", "write the horcruxes to this directory (by default, the one the file is in, or the current one for stdin)")
+			flags.BoolVar(&options.Overwrite, "force", false, "overwrite any existing files with the same names as the horcruxes")
+			flags.Var(modeValue{&options.Mode}, "mode", "give the horcruxes these `permissions`, in octal (default 0600)")
+			addNonInteractiveFlag(flags, &nonInteractive)
+		},
+		Run: func(args []string) error {
+			if len(args) != 1 {
+				return cli.Usagef("expected one file to split")
+			}
+			path := args[0]
+			fromStdin := path == "-"
+
+			if fromStdin && name == "" {
+				return cli.Usagef("-name is required when splitting stdin")
+			}
+			if !fromStdin && name != "" {
+				return cli.Usagef("-name is only for splitting stdin")
+			}
+
+			if options.Total == 0 || options.Threshold == 0 {
+				// when we're splitting stdin, it's not there for answering
+				// questions
+				if fromStdin || !canPrompt(nonInteractive) {
+					return cli.Usagef("-n and -t are required when running non-interactively")
+				}
+				var err error
+				options.Total, options.Threshold, err = commands.PromptForTotalAndThreshold(options.Total, options.Threshold)
+				if err != nil {
+					return err
 				}
-				overwriteResponse := commands.Prompt("A file already exists at destination. Overwrite? (Y/N):")
-				if overwriteResponse == "Y" || overwriteResponse == "y" || overwriteResponse == "yes" {
-					overwrite = true
+			}
+			if err := commands.ValidateTotalAndThreshold(options.Total, options.Threshold); err != nil {
+				return cli.Usagef("%s", err)
+			}
+
+			if fromStdin {
+				if outputDir == "" {
+					outputDir = "."
+				}
+				return commands.SplitReader(os.Stdin, name, outputDir, options)
+			}
+			if outputDir == "" {
+				// Clean, so that the horcruxes of secrets/ go next to it
+				// rather than in it
+				outputDir = filepath.Dir(filepath.Clean(path))
+			}
+			return commands.Split(path, outputDir, options)
+		},
+	}
+}
+
+func bindCommand() *cli.Command {
+	var selection, outputPath, outputDir string
+	var force, noClobber, nonInteractive, toStdout, noOwner bool
+	var mode os.FileMode
+	discoveryOptions := &commands.DiscoveryOptions{}
+
+	return &cli.Command{
+		Name:    "bind",
+		Args:    "[<directory | horcrux>...]",
+		Summary: "resurrect the original files from horcruxes",
+		Description: "Resurrect the original file of each set of horcruxes found at the given\n" +
+			"locations (or in the current directory), by default into the current\n" +
+			"directory.",
+		SetFlags: func(flags *flag.FlagSet) {
+			flags.StringVar(&selection, "set", "", "only bind the set with this set ID (or a prefix of it) or original filename")
+			flags.BoolVar(&force, "force", false, "overwrite existing files without asking")
+			flags.BoolVar(&force, "yes", false, "answer yes to every question: the same as -force")
+			flags.BoolVar(&noClobber, "no-clobber", false, "never overwrite existing files")
+			flags.StringVar(&outputPath, "o", "", "write the original file to this path (when binding a single set)")
+			flags.StringVar(&outputDir, "output-dir", "", "write original files to this directory rather than the current one")
+			flags.BoolVar(&toStdout, "stdout", false, "write the original file to stdout rather than to disk")
+			flags.BoolVar(&noOwner, "no-owner", false, "don't give the original file back its original owner")
+			flags.Var(modeValue{&mode}, "mode", "give the original file these `permissions`, in octal (default: the original file's, or 0600)")
+			addNonInteractiveFlag(flags, &nonInteractive)
+			addDiscoveryFlags(flags, discoveryOptions)
+		},
+		Run: func(args []string) error {
+			if force && noClobber {
+				return cli.Usagef("-force and -no-clobber can't be used together")
+			}
+			if countSet(outputPath != "", outputDir != "", toStdout) > 1 {
+				return cli.Usagef("only one of -o, -output-dir and -stdout can be used")
+			}
+
+			if toStdout {
+				// anything we have to say, even while we're looking for the
+				// horcruxes, would get mixed up with the file
+				commands.Messages = os.Stderr
+			}
+
+			paths, err := findHorcruxPaths(args, *discoveryOptions)
+			if err != nil {
+				return err
+			}
+
+			if toStdout {
+				return commands.BindToWriter(paths, selection, os.Stdout)
+			}
+
+			confirmOverwrite := func(dstPath string) bool {
+				if force {
+					return true
+				}
+				if noClobber {
+					return false
+				}
+				if !canPrompt(nonInteractive) {
+					fmt.Printf("%s already exists and we can't ask whether to overwrite it: pass -force to overwrite it\n", dstPath)
+					return false
+				}
+				overwriteResponse := commands.Prompt("A file already exists at %s. Overwrite? (Y/N):", dstPath)
+				return overwriteResponse == "Y" || overwriteResponse == "y" || overwriteResponse == "yes"
+			}
+
+			return commands.BindAll(paths, commands.BindOptions{
+				Selection:        selection,
+				OutputPath:       outputPath,
+				OutputDir:        outputDir,
+				SkipOwner:        noOwner,
+				Mode:             mode,
+				ConfirmOverwrite: confirmOverwrite,
+			})
+		},
+	}
+}
+
+func verifyCommand() *cli.Command {
+	discoveryOptions := &commands.DiscoveryOptions{}
+
+	return &cli.Command{
+		Name:    "verify",
+		Args:    "[<directory | horcrux>...]",
+		Summary: "check that a set of horcruxes can be bound, without binding it",
+		SetFlags: func(flags *flag.FlagSet) {
+			addDiscoveryFlags(flags, discoveryOptions)
+		},
+		Run: func(args []string) error {
+			// a horcrux that isn't where we were told it is gets reported as
+			// missing, rather than stopping us from checking the rest
+			locations := []string{}
+			missing := []string{}
+			for _, arg := range args {
+				if _, err := os.Stat(arg); os.IsNotExist(err) {
+					missing = append(missing, arg)
 				} else {
-					log.Fatal("You have chosen not to overwrite the file. Cancelling.")
+					locations = append(locations, arg)
 				}
-			} else {
-				break
 			}
-		}
 
-		return
+			paths := []string{}
+			if len(args) == 0 || len(locations) > 0 {
+				var err error
+				paths, err = findHorcruxPaths(locations, *discoveryOptions)
+				if err != nil {
+					return err
+				}
+			}
+
+			return commands.Verify(append(paths, missing...))
+		},
 	}
+}
 
-	if os.Args[len(os.Args)-2] == "split" {
-		if len(os.Args) == 2 {
-			usage()
-		}
-		path := os.Args[len(os.Args)-1]
-		if err := commands.SplitWithPrompt(path); err != nil {
-			log.Fatal(err)
-		}
-		return
+func statusCommand() *cli.Command {
+	discoveryOptions := &commands.DiscoveryOptions{}
+
+	return &cli.Command{
+		Name:    "status",
+		Args:    "[<directory | horcrux>...]",
+		Summary: "list which horcruxes each set is missing",
+		SetFlags: func(flags *flag.FlagSet) {
+			addDiscoveryFlags(flags, discoveryOptions)
+		},
+		Run: func(args []string) error {
+			paths, err := findHorcruxPaths(args, *discoveryOptions)
+			if err != nil {
+				return err
+			}
+
+			return commands.Status(paths)
+		},
+	}
+}
+
+func inspectCommand() *cli.Command {
+	var asJSON, showKeyFragment bool
+
+	return &cli.Command{
+		Name:    "inspect",
+		Args:    "<horcrux>...",
+		Summary: "print what a horcrux says about itself",
+		SetFlags: func(flags *flag.FlagSet) {
+			flags.BoolVar(&asJSON, "json", false, "print the details as JSON")
+			flags.BoolVar(&showKeyFragment, "show-key-fragment", false, "include the horcrux's key fragment (keep it secret!)")
+		},
+		Run: func(args []string) error {
+			if len(args) == 0 {
+				return cli.Usagef("expected at least one horcrux to inspect")
+			}
+
+			return commands.Inspect(args, asJSON, showKeyFragment)
+		},
 	}
+}
+
+func upgradeCommand() *cli.Command {
+	discoveryOptions := &commands.DiscoveryOptions{}
+
+	return &cli.Command{
+		Name:    "upgrade",
+		Args:    "[<directory | horcrux>...]",
+		Summary: "re-encode a set of horcruxes in the newest format",
+		SetFlags: func(flags *flag.FlagSet) {
+			addDiscoveryFlags(flags, discoveryOptions)
+		},
+		Run: func(args []string) error {
+			paths, err := findHorcruxPaths(args, *discoveryOptions)
+			if err != nil {
+				return err
+			}
 
-	usage()
+			return commands.Upgrade(paths)
+		},
+	}
 }
 
-func usage() {
-	log.Fatal("usage: `horcrux bind [<directory>]` | `horcrux [-t] [-n] split <filename>`\n-n: number of horcruxes to make\n-t: number of horcruxes required to resurrect the original file\nexample: horcrux -t 3 -n 5 split diary.txt")
+// addDiscoveryFlags adds the flags that control where we look for horcruxes
+func addDiscoveryFlags(flags *flag.FlagSet, options *commands.DiscoveryOptions) {
+	flags.IntVar(&options.MaxDepth, "max-depth", commands.DefaultMaxDepth, "how many levels of subdirectories to look for horcruxes in")
+	flags.BoolVar(&options.FollowSymlinks, "follow-symlinks", false, "follow symlinks when looking for horcruxes")
+}
+
+// findHorcruxPaths returns the paths of the horcruxes at the given locations,
+// or in the current directory if there aren't any
+func findHorcruxPaths(locations []string, options commands.DiscoveryOptions) ([]string, error) {
+	if len(locations) == 0 {
+		locations = []string{"."}
+	}
+	return commands.FindHorcruxPaths(locations, options)
+}
+
+// modeValue is a flag for file permissions, in octal like chmod takes them
+type modeValue struct {
+	mode *os.FileMode
+}
+
+func (v modeValue) String() string {
+	if v.mode == nil || *v.mode == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04o", *v.mode)
+}
+
+func (v modeValue) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("%q isn't a file mode: use octal permissions like 0600", value)
+	}
+	if mode == 0 {
+		return errors.New("a mode of 0 would leave nobody able to read the file")
+	}
+	*v.mode = os.FileMode(mode)
+	return nil
+}
+
+// countSet returns how many of the given flags are set
+func countSet(values ...bool) int {
+	count := 0
+	for _, value := range values {
+		if value {
+			count++
+		}
+	}
+	return count
 }
@@ -0,0 +1,243 @@
+package cli
+
+// A small subcommand framework on top of the standard flag package, so that
+// horcrux can stay free of dependencies. Every command gets a flag set of its
+// own and a --help, flags may come before or after a command's arguments, and
+// every command exits with the same codes.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Exit codes
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	// ExitUsage means the command was used wrongly: an unknown command or flag,
+	// or the wrong arguments.
+	ExitUsage = 2
+)
+
+// Command is a subcommand, like `split` in `horcrux split diary.txt`
+type Command struct {
+	Name string
+	// Args describes the command's arguments for its usage line, e.g. "<filename>"
+	Args string
+	// Summary is a one-line description for the list of commands
+	Summary string
+	// Description is shown in the command's --help, below its usage line
+	Description string
+	// SetFlags defines the command's flags. The values of the flags are only
+	// set by the time Run is called.
+	SetFlags func(flags *flag.FlagSet)
+	// Run runs the command with its (non-flag) arguments. Return a UsageError
+	// if the arguments don't make sense.
+	Run func(args []string) error
+}
+
+// UsageError is returned by a command that has been used wrongly, so that we
+// can show the user how to use it
+type UsageError struct {
+	message string
+}
+
+func (e *UsageError) Error() string {
+	return e.message
+}
+
+// Usagef returns a UsageError
+func Usagef(format string, args ...interface{}) error {
+	return &UsageError{message: fmt.Sprintf(format, args...)}
+}
+
+// App is a program made up of subcommands
+type App struct {
+	Name     string
+	Commands []*Command
+	// Examples are shown at the bottom of the program's help
+	Examples []string
+	// ExitCode returns the code to exit with when a command fails with the
+	// given error (other than a UsageError). Without it, or if it returns
+	// ExitOK, we exit with ExitFailure.
+	ExitCode func(err error) int
+}
+
+// Run runs the command named by the first of the given arguments (which
+// shouldn't include the program name) and returns the code to exit with.
+func (a *App) Run(args []string) int {
+	args = a.moveLeadingFlags(args)
+
+	if len(args) == 0 {
+		a.printHelp(os.Stderr)
+		return ExitUsage
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			if command := a.command(args[1]); command != nil {
+				a.printCommandHelp(os.Stdout, command, newFlagSet(command))
+				return ExitOK
+			}
+			fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", a.Name, args[1])
+			a.printHelp(os.Stderr)
+			return ExitUsage
+		}
+		a.printHelp(os.Stdout)
+		return ExitOK
+	}
+
+	command := a.command(args[0])
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", a.Name, args[0])
+		a.printHelp(os.Stderr)
+		return ExitUsage
+	}
+
+	flags := newFlagSet(command)
+	positional, err := parseInterspersed(flags, args[1:])
+	if err == flag.ErrHelp {
+		a.printCommandHelp(os.Stdout, command, flags)
+		return ExitOK
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n\n", a.Name, command.Name, err)
+		a.printCommandHelp(os.Stderr, command, flags)
+		return ExitUsage
+	}
+
+	if err := command.Run(positional); err != nil {
+		var usageErr *UsageError
+		if errors.As(err, &usageErr) {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n\n", a.Name, command.Name, err)
+			a.printCommandHelp(os.Stderr, command, flags)
+			return ExitUsage
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a.Name, err)
+		return a.exitCode(err)
+	}
+
+	return ExitOK
+}
+
+func (a *App) exitCode(err error) int {
+	if a.ExitCode == nil {
+		return ExitFailure
+	}
+	if code := a.ExitCode(err); code != ExitOK {
+		return code
+	}
+	return ExitFailure
+}
+
+func (a *App) command(name string) *Command {
+	for _, command := range a.Commands {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+// moveLeadingFlags supports the way horcrux used to be called, with the flags
+// before the command (`horcrux -t 3 -n 5 split diary.txt`), by moving any such
+// flags after the command.
+func (a *App) moveLeadingFlags(args []string) []string {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "-") {
+		return args
+	}
+	for i, arg := range args {
+		if a.command(arg) != nil {
+			moved := append([]string{arg}, args[:i]...)
+			return append(moved, args[i+1:]...)
+		}
+	}
+	return args
+}
+
+func newFlagSet(command *Command) *flag.FlagSet {
+	flags := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+	// we print errors and usage ourselves
+	flags.SetOutput(ioutil.Discard)
+	if command.SetFlags != nil {
+		command.SetFlags(flags)
+	}
+	return flags
+}
+
+// parseInterspersed parses the flags among args, which unlike flag.Parse
+// allows flags to come after the arguments as well as before them. Everything
+// after a "--" is an argument.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+
+		remaining := flags.Args()
+		consumed := len(args) - len(remaining)
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, remaining...), nil
+		}
+		if len(remaining) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, remaining[0])
+		args = remaining[1:]
+	}
+}
+
+func (a *App) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [arguments]\n\ncommands:\n", a.Name)
+	width := 0
+	for _, command := range a.Commands {
+		if len(command.Name) > width {
+			width = len(command.Name)
+		}
+	}
+	for _, command := range a.Commands {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, command.Name, command.Summary)
+	}
+	fmt.Fprintf(w, "\nRun `%s <command> --help` for more about a command.\n", a.Name)
+	if len(a.Examples) > 0 {
+		fmt.Fprintf(w, "\nexamples:\n")
+		for _, example := range a.Examples {
+			fmt.Fprintf(w, "  %s\n", example)
+		}
+	}
+}
+
+func (a *App) printCommandHelp(w io.Writer, command *Command, flags *flag.FlagSet) {
+	hasFlags := false
+	flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+
+	usage := fmt.Sprintf("usage: %s %s", a.Name, command.Name)
+	if hasFlags {
+		usage += " [flags]"
+	}
+	if command.Args != "" {
+		usage += " " + command.Args
+	}
+	fmt.Fprintln(w, usage)
+
+	description := command.Description
+	if description == "" {
+		description = command.Summary
+	}
+	fmt.Fprintf(w, "\n%s\n", description)
+
+	if hasFlags {
+		fmt.Fprintf(w, "\nflags:\n")
+		flags.SetOutput(w)
+		flags.PrintDefaults()
+		flags.SetOutput(ioutil.Discard)
+	}
+}
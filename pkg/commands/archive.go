@@ -0,0 +1,336 @@
+package commands
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A directory is split by streaming it through the same pipeline as a file,
+// as a tar archive. The archive is written and read on the fly, so it never
+// touches the disk unencrypted.
+
+// ArchiveTar is what the header's Archive field says when the original was a
+// directory, archived with tar
+const ArchiveTar = "tar"
+
+// newDirectoryReader returns a reader of a tar archive of the directory at
+// root. Close it if you stop reading before the end, so that we stop writing.
+func newDirectoryReader(root string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTarArchive(pw, root))
+	}()
+	return pr
+}
+
+// writeTarArchive writes everything in the directory at root to w as a tar
+// archive, with paths relative to root. The root itself isn't in the archive:
+// its permissions and the like are sealed in the header like those of a file.
+// Symlinks are archived as symlinks, never followed, and anything that isn't a
+// regular file, a directory or a symlink (like a socket) is skipped.
+func writeTarArchive(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		name := filepath.ToSlash(rel)
+		if err := validateArchivePath(name); err != nil {
+			return fmt.Errorf("can't split %s: %s", filePath, err)
+		}
+
+		link := ""
+		switch {
+		case info.Mode().IsRegular(), info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		default:
+			fmt.Printf("skipping %s: only regular files, directories and symlinks can be split\n", filePath)
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		// otherwise modification times are rounded to the second. We don't
+		// restore access or change times, so there's no need to keep them.
+		header.Format = tar.FormatPAX
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// validateArchivePath makes sure that a slash-separated path from an archive
+// can only ever name something inside the directory we extract it into. Each
+// element of the path has to pass muster as an original filename.
+func validateArchivePath(name string) error {
+	if strings.HasPrefix(name, "/") {
+		return errors.New("it is an absolute path")
+	}
+	for _, element := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if err := validateOriginalFilename(element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTarArchive recreates the tree in the tar archive read from r inside
+// dir, which should be empty. Nothing is ever written outside of dir:
+//
+//   - every path is checked by validateArchivePath
+//   - symlinks are only created once everything else has been extracted, so
+//     we never write through one
+//   - symlinks that point outside of the tree (or anywhere absolute) are
+//     skipped, so that the tree can't be used to reach anything else
+//
+// Permissions are restored, apart from setuid and the like, along with
+// modification times and, unless options.SkipOwner is set, owners. If
+// options.Mode is set, files are given it instead of their own permissions.
+// dstPath is where dir will end up, for telling the user about what we skip.
+func extractTarArchive(r io.Reader, dir string, dstPath string, options BindOptions) error {
+	extractor := &tarExtractor{dir: dir, dstPath: dstPath, options: options}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := extractor.extract(header, tr); err != nil {
+			return err
+		}
+	}
+
+	return extractor.finish()
+}
+
+type tarExtractor struct {
+	dir     string
+	dstPath string
+	options BindOptions
+	// directories and symlinks are finished off once everything else has
+	// been extracted: directories because extracting their contents would
+	// change their modification times (and their permissions might not let
+	// us), and symlinks so that we never write through them.
+	directories  []*tar.Header
+	symlinks     []*tar.Header
+	ownerWarning bool
+}
+
+func (e *tarExtractor) extract(header *tar.Header, r io.Reader) error {
+	if err := validateArchivePath(header.Name); err != nil {
+		return fmt.Errorf("%w %q: %s", ErrUnsafeArchive, header.Name, err)
+	}
+	target := e.target(header)
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		e.directories = append(e.directories, header)
+		return os.MkdirAll(target, 0700)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		// O_EXCL so that an archive can't name the same file twice
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(file, r); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+
+		e.restoreOwner(target, header)
+
+		mode := e.options.Mode
+		if mode == 0 {
+			mode = header.FileInfo().Mode().Perm()
+		}
+		if err := file.Chmod(mode); err != nil {
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(target, header.ModTime, header.ModTime)
+	case tar.TypeSymlink:
+		if filepath.IsAbs(header.Linkname) || strings.HasPrefix(header.Linkname, "/") ||
+			escapesTree(path.Join(path.Dir(strings.TrimSuffix(header.Name, "/")), header.Linkname)) {
+			fmt.Fprintf(Messages, "skipping symlink %s: it points to %s, which is outside of the directory\n", e.display(target), display(header.Linkname))
+			return nil
+		}
+		e.symlinks = append(e.symlinks, header)
+		return nil
+	default:
+		fmt.Fprintf(Messages, "skipping %s: only regular files, directories and symlinks can be resurrected\n", e.display(target))
+		return nil
+	}
+}
+
+func (e *tarExtractor) finish() error {
+	realDir, err := filepath.EvalSymlinks(e.dir)
+	if err != nil {
+		return err
+	}
+
+	// symlinks can point through each other, so checking where each one points
+	// on its own isn't enough: once they're all there we check where they
+	// really lead.
+	created := []string{}
+	for _, header := range e.symlinks {
+		target := e.target(header)
+		if !e.isRealDirectory(realDir, filepath.Dir(target)) {
+			fmt.Fprintf(Messages, "skipping symlink %s: its directory is missing or is itself a symlink\n", e.display(target))
+			continue
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+		e.restoreOwner(target, header)
+		created = append(created, target)
+	}
+	for _, target := range created {
+		resolved, err := filepath.EvalSymlinks(target)
+		if err != nil {
+			// a dangling symlink doesn't lead anywhere
+			continue
+		}
+		if rel, err := filepath.Rel(realDir, resolved); err != nil || escapesTree(filepath.ToSlash(rel)) {
+			fmt.Fprintf(Messages, "skipping symlink %s: it leads outside of the directory\n", e.display(target))
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	// subdirectories come after their parents in the archive, so we go
+	// backwards to finish them first, in case their parent's permissions
+	// won't let us into it once it's finished.
+	for i := len(e.directories) - 1; i >= 0; i-- {
+		header := e.directories[i]
+		target := e.target(header)
+		e.restoreOwner(target, header)
+		if err := os.Chmod(target, header.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isRealDirectory tells us whether dir is a directory inside the one we're
+// extracting into that we can get to without going through any symlinks
+func (e *tarExtractor) isRealDirectory(realDir string, dir string) bool {
+	rel, err := filepath.Rel(e.dir, dir)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	return err == nil && resolved == filepath.Join(realDir, rel)
+}
+
+func (e *tarExtractor) target(header *tar.Header) string {
+	return filepath.Join(e.dir, filepath.FromSlash(strings.TrimSuffix(header.Name, "/")))
+}
+
+// display returns the path target will have once the directory is in place
+func (e *tarExtractor) display(target string) string {
+	rel, err := filepath.Rel(e.dir, target)
+	if err != nil {
+		return target
+	}
+	return filepath.Join(e.dstPath, rel)
+}
+
+// restoreOwner gives what's at target the owner recorded in the archive, if
+// we've been asked to. Like with a file, failing to is just a warning, and we
+// only warn once rather than for every file in the tree.
+func (e *tarExtractor) restoreOwner(target string, header *tar.Header) {
+	if e.options.SkipOwner {
+		return
+	}
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil && !e.ownerWarning {
+		if pathErr, ok := err.(*os.PathError); ok {
+			err = pathErr.Err
+		}
+		fmt.Fprintf(Messages, "could not give the files in the directory their original owners (pass -no-owner to not try): %s\n", err)
+		e.ownerWarning = true
+	}
+}
+
+// escapesTree tells us whether a cleaned slash-separated relative path leads
+// out of the directory it's relative to
+func escapesTree(name string) bool {
+	return name == ".." || strings.HasPrefix(name, "../")
+}
+
+// removeAllWithin removes dir, which we've created, and everything in it,
+// even if we've since taken away our own permission to write to parts of it.
+func removeAllWithin(dir string) {
+	_ = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			_ = os.Chmod(filePath, 0700)
+		}
+		return nil
+	})
+	_ = os.RemoveAll(dir)
+}
@@ -0,0 +1,197 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tarEntry is an entry of a test archive: a directory if its name ends in a
+// slash, a symlink if it has a link and a regular file otherwise
+type tarEntry struct {
+	name    string
+	link    string
+	content string
+}
+
+func makeTarArchive(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0700, ModTime: time.Unix(1600000000, 0)}
+		switch {
+		case entry.name[len(entry.name)-1] == '/':
+			header.Typeflag = tar.TypeDir
+		case entry.link != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.link
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(entry.content))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// extractTestArchive extracts the entries into the directory "tree" inside a
+// new temp directory, which it returns. Remove it once you're done.
+func extractTestArchive(t *testing.T, entries []tarEntry) (string, error) {
+	t.Helper()
+	Messages = ioutil.Discard
+
+	base, err := ioutil.TempDir("", "horcrux-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(base, "tree"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	err = extractTarArchive(makeTarArchive(t, entries), filepath.Join(base, "tree"), "tree", BindOptions{SkipOwner: true})
+	return base, err
+}
+
+func assertNotExists(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to exist, got %v", path, err)
+	}
+}
+
+func TestExtractTarArchiveRejectsParentPaths(t *testing.T) {
+	for _, name := range []string{"../escaped", "sub/../../escaped", "/escaped"} {
+		base, err := extractTestArchive(t, []tarEntry{{name: name, content: "gotcha"}})
+		defer os.RemoveAll(base)
+
+		if !errors.Is(err, ErrUnsafeArchive) {
+			t.Errorf("%s: expected ErrUnsafeArchive, got %v", name, err)
+		}
+		assertNotExists(t, filepath.Join(base, "escaped"))
+	}
+}
+
+func TestExtractTarArchiveSkipsSymlinksOutOfTheTree(t *testing.T) {
+	base, err := extractTestArchive(t, []tarEntry{
+		{name: "absolute", link: "/etc"},
+		{name: "parent", link: "../outside"},
+		{name: "sub/"},
+		{name: "sub/up", link: ".."},
+		// every link in the chain stays inside the tree on its own, but
+		// together they lead out of it
+		{name: "sub/chain", link: "up/.."},
+		{name: "inside", link: "sub"},
+	})
+	defer os.RemoveAll(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := filepath.Join(base, "tree")
+	assertNotExists(t, filepath.Join(tree, "absolute"))
+	assertNotExists(t, filepath.Join(tree, "parent"))
+	assertNotExists(t, filepath.Join(tree, "sub", "chain"))
+
+	for _, name := range []string{"sub/up", "inside"} {
+		if info, err := os.Lstat(filepath.Join(tree, name)); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected %s to be a symlink, got %v", name, err)
+		}
+	}
+}
+
+func TestExtractTarArchiveDoesNotWriteThroughSymlinks(t *testing.T) {
+	// outside of the tree, so the symlink is skipped and the file goes in a
+	// real directory instead
+	base, err := extractTestArchive(t, []tarEntry{
+		{name: "link", link: "../outside"},
+		{name: "link/file", content: "gotcha"},
+	})
+	defer os.RemoveAll(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNotExists(t, filepath.Join(base, "outside"))
+	if info, err := os.Lstat(filepath.Join(base, "tree", "link")); err != nil || !info.IsDir() {
+		t.Errorf("expected link to be a directory, got %v", err)
+	}
+
+	// inside the tree, so the symlink can't be created where the file's
+	// directory already is
+	base, err = extractTestArchive(t, []tarEntry{
+		{name: "sub/"},
+		{name: "link", link: "sub"},
+		{name: "link/file", content: "gotcha"},
+	})
+	defer os.RemoveAll(base)
+	if err == nil {
+		t.Error("expected an error extracting a file through a symlink")
+	}
+	assertNotExists(t, filepath.Join(base, "tree", "sub", "file"))
+}
+
+func TestExtractTarArchiveRejectsDuplicateFiles(t *testing.T) {
+	base, err := extractTestArchive(t, []tarEntry{
+		{name: "file", content: "first"},
+		{name: "file", content: "second"},
+	})
+	defer os.RemoveAll(base)
+
+	if !os.IsExist(err) {
+		t.Errorf("expected an error saying the file exists, got %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(base, "tree", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "first" {
+		t.Errorf("expected the first file to be left alone, got %q", content)
+	}
+}
+
+func TestWriteTarArchiveKeepsModificationTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "horcrux-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Unix(1600000000, 123456789)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTarArchive(&buf, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := tar.NewReader(&buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.ModTime.Equal(info.ModTime()) {
+		t.Errorf("expected modification time %s, got %s", info.ModTime(), header.ModTime)
+	}
+}
@@ -0,0 +1,218 @@
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is a file that only appears at its path once it's been written
+// in full. Until then it's a temp file in the same directory (so that moving it
+// into place is a rename rather than a copy), and if anything goes wrong it's
+// removed, leaving whatever was at the path before untouched.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+// createAtomicFile creates a temp file that Commit will move to path. Its name
+// starts with a dot and doesn't end in .horcrux, so a temp file left behind by
+// a crash isn't mistaken for a horcrux.
+func createAtomicFile(path string, perm os.FileMode) (*atomicFile, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &atomicFile{File: file, path: path}, nil
+}
+
+// Commit flushes the file to disk and moves it into place, replacing anything
+// that was already there
+func (f *atomicFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	syncDir(filepath.Dir(f.path))
+
+	return nil
+}
+
+// Abort closes and removes the temp file. It's safe to call after Commit has
+// failed.
+func (f *atomicFile) Abort() {
+	f.Close()
+	_ = os.Remove(f.Name())
+}
+
+// commitAll commits every one of the files or, if any of them can't be
+// committed, none of them. Whatever a file replaces is moved aside rather than
+// renamed over, and only removed once every file has been committed, so that
+// if one fails we can take back the ones already committed and put everything
+// they replaced back where it was.
+func commitAll(files []*atomicFile) error {
+	return commitAllKeeping(files, nil)
+}
+
+// commitAllKeeping is commitAll, except that whatever files[i] replaces is
+// kept at backups[i] rather than removed, unless backups[i] is "". There must
+// be nothing at a backup path already.
+func commitAllKeeping(files []*atomicFile, backups []string) error {
+	keep := func(i int) bool {
+		return i < len(backups) && backups[i] != ""
+	}
+
+	// olds[i] is where whatever was at files[i].path has been moved to, if
+	// anything was there
+	olds := make([]string, len(files))
+	committed := 0
+	var err error
+	for i, file := range files {
+		if keep(i) {
+			olds[i], err = moveTo(file.path, backups[i])
+		} else {
+			olds[i], err = moveAside(file.path)
+		}
+		if err != nil {
+			break
+		}
+		if err = file.Commit(); err != nil {
+			break
+		}
+		committed++
+	}
+
+	if err == nil {
+		for i, old := range olds {
+			if old != "" && !keep(i) {
+				removeAllWithin(filepath.Dir(old))
+			}
+		}
+		return nil
+	}
+
+	for _, file := range files[:committed] {
+		_ = os.Remove(file.path)
+	}
+	for _, file := range files[committed:] {
+		file.Abort()
+	}
+	for i, old := range olds {
+		switch {
+		case old == "":
+		case keep(i):
+			_ = os.Rename(old, files[i].path)
+		default:
+			putBack(old, files[i].path)
+		}
+	}
+	return err
+}
+
+// replaceWithDirectory moves the directory at tmpDir (which should be next to
+// dstPath) to dstPath, replacing anything that's already there. Unlike a file,
+// a directory can't be renamed over something else, so whatever's there is
+// moved out of the way first, and put back if we can't move the new
+// directory into place.
+func replaceWithDirectory(tmpDir string, dstPath string) error {
+	old, err := moveAside(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpDir, dstPath); err != nil {
+		if old != "" {
+			putBack(old, dstPath)
+		}
+		return err
+	}
+	syncDir(filepath.Dir(dstPath))
+
+	if old != "" {
+		removeAllWithin(filepath.Dir(old))
+	}
+	return nil
+}
+
+// moveAside moves whatever is at path into a new hidden directory next to it
+// and returns where it's gone, or "" if there was nothing there. Once it's no
+// longer needed, remove the directory it's in with removeAllWithin, or move it
+// back with putBack.
+func moveAside(path string) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	oldDir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path)+".*.old")
+	if err != nil {
+		return "", err
+	}
+	old := filepath.Join(oldDir, filepath.Base(path))
+
+	if err := os.Rename(path, old); err != nil {
+		_ = os.Remove(oldDir)
+		return "", err
+	}
+	return old, nil
+}
+
+// moveTo moves whatever is at path to backup, which mustn't exist yet, and
+// returns backup, or "" if there was nothing at path. Move it back with
+// os.Rename if it turns out that it's still needed where it was.
+func moveTo(path string, backup string) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if _, err := os.Lstat(backup); err == nil {
+		return "", fmt.Errorf("%s already exists", backup)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := os.Rename(path, backup); err != nil {
+		return "", err
+	}
+	return backup, nil
+}
+
+// putBack undoes moveAside
+func putBack(old string, path string) {
+	_ = os.Rename(old, path)
+	_ = os.Remove(filepath.Dir(old))
+}
+
+// syncDir flushes a directory's entries to disk, so that a file we've renamed
+// into it is still there after a crash. Not every platform lets us do this
+// (Windows doesn't), so it's only done where we can.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
@@ -9,9 +9,11 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/jesseduffield/horcrux/pkg/encryption"
+	"github.com/jesseduffield/horcrux/pkg/erasure"
 	"github.com/jesseduffield/horcrux/pkg/multiplexing"
-	"github.com/jesseduffield/horcrux/pkg/shamir"
 )
 
 func GetHorcruxPathsInDir(dir string) ([]string, error) {
@@ -45,20 +47,33 @@ func (h byIndex) Less(i, j int) bool {
 	return h[i].GetHeader().Index < h[j].GetHeader().Index
 }
 
+// GetHorcruxes reads the horcruxes at the given paths, sorted by index. If the
+// same horcrux turns up more than once (say, because it was backed up to two
+// of the places we looked), we only keep the first copy. A file without a valid
+// horcrux header is skipped with a warning, so that one bad file among the
+// ones we found doesn't stop us from using the rest, but a file we can't read
+// at all is an error: it may well be a horcrux we need. Only the headers are
+// read, and none of the files are left open.
 func GetHorcruxes(paths []string) ([]Horcrux, error) {
 	horcruxes := []Horcrux{}
+	seen := map[string]bool{}
 
 	for _, path := range paths {
 		currentHorcrux, err := NewHorcrux(path)
+		if errors.Is(err, ErrInvalidHeader) {
+			fmt.Fprintf(Messages, "skipping %s: could not read horcrux: %s\n", path, err)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
-		for _, horcrux := range horcruxes {
-			if horcrux.GetHeader().Index == currentHorcrux.GetHeader().Index && horcrux.GetHeader().OriginalFilename == currentHorcrux.GetHeader().OriginalFilename {
-				// we've already obtained this horcrux so we'll skip this instance
-				continue
-			}
+
+		id := fmt.Sprintf("%s/%d", currentHorcrux.GetHeader().setKey(), currentHorcrux.GetHeader().Index)
+		if seen[id] {
+			// we've already obtained this horcrux so we'll skip this instance
+			continue
 		}
+		seen[id] = true
 
 		horcruxes = append(horcruxes, *currentHorcrux)
 	}
@@ -70,90 +85,592 @@ func GetHorcruxes(paths []string) ([]Horcrux, error) {
 
 func ValidateHorcruxes(horcruxes []Horcrux) error {
 	if len(horcruxes) == 0 {
-		return errors.New("No horcruxes supplied")
+		return &NotEnoughHorcruxesError{}
+	}
+
+	for _, horcrux := range horcruxes {
+		if err := checkTotalAndThreshold(horcrux); err != nil {
+			return err
+		}
+		if err := checkFormat(horcrux); err != nil {
+			return err
+		}
 	}
 
 	if len(horcruxes) < horcruxes[0].GetHeader().Threshold {
-		return fmt.Errorf(
-			"You do not have all the required horcruxes. There are %d required to resurrect the original file. You only have %d",
-			horcruxes[0].GetHeader().Threshold,
-			len(horcruxes),
-		)
+		return &NotEnoughHorcruxesError{Have: len(horcruxes), Required: horcruxes[0].GetHeader().Threshold}
 	}
 
 	for _, horcrux := range horcruxes {
+		if horcrux.GetHeader().Index < 1 || horcrux.GetHeader().Index > horcrux.GetHeader().Total {
+			return fmt.Errorf("%s has an invalid index of %d", horcrux.GetPath(), horcrux.GetHeader().Index)
+		}
+		if err := validateOriginalFilename(horcrux.GetHeader().OriginalFilename); err != nil {
+			return &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its header has an unsafe original filename %q: %s", horcrux.GetHeader().OriginalFilename, err)}
+		}
 		if !strings.HasSuffix(horcrux.GetPath(), ".horcrux") {
 			return fmt.Errorf("%s is not a horcrux file (requires .horcrux extension)", horcrux.GetPath())
 		}
-		if horcrux.GetHeader().OriginalFilename != horcruxes[0].GetHeader().OriginalFilename || horcrux.GetHeader().Timestamp != horcruxes[0].GetHeader().Timestamp {
-			return errors.New("All horcruxes in the given directory must have the same original filename and timestamp.")
+		if horcrux.GetHeader().setKey() != horcruxes[0].GetHeader().setKey() {
+			if horcruxes[0].GetHeader().SetID == "" {
+				return errors.New("All horcruxes in the given directory must have the same original filename and timestamp.")
+			}
+			return errors.New("All horcruxes in the given directory must belong to the same set.")
+		}
+		if horcrux.GetHeader().Version != horcruxes[0].GetHeader().Version || horcrux.GetHeader().bodyMode() != horcruxes[0].GetHeader().bodyMode() || horcrux.GetHeader().KeyScheme != horcruxes[0].GetHeader().KeyScheme {
+			return errors.New("All horcruxes in the given directory must have the same format version, body mode and key scheme.")
 		}
 	}
 
 	return nil
 }
 
+// checkTotalAndThreshold makes sure that the total and threshold in the
+// horcrux's header are ones that split could have made, because everything
+// else takes them at their word.
+func checkTotalAndThreshold(horcrux Horcrux) error {
+	header := horcrux.GetHeader()
+	if err := ValidateTotalAndThreshold(header.Total, header.Threshold); err != nil {
+		return &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its header says it's one of %d horcruxes, %d of which are required, but %s", header.Total, header.Threshold, err)}
+	}
+	return nil
+}
+
 func Bind(paths []string, dstPath string, overwrite bool) error {
 	horcruxes, err := GetHorcruxes(paths)
 	if err != nil {
 		return err
 	}
 
+	return bindSet(horcruxes, dstPath, overwrite, BindOptions{})
+}
+
+// BindOptions controls where BindAll resurrects original files
+type BindOptions struct {
+	// Selection picks out the one set to bind (see SelectHorcruxSet). If it's
+	// empty, every set is bound.
+	Selection string
+	// OutputPath is where to write the original file. It can only be used
+	// when there's one set to bind.
+	OutputPath string
+	// OutputDir is the directory original files are written to, under their
+	// original filenames. It's created if need be. If it and OutputPath are
+	// empty, we use the current directory.
+	OutputDir string
+	// SkipOwner stops us from giving resurrected files the owner the original
+	// file had (their permissions and modification time are still restored)
+	SkipOwner bool
+	// Mode is the permissions resurrected files are given. If it's zero they
+	// get the original file's permissions, or DefaultFileMode if we don't know
+	// what those were. When the original was a directory, it's given to each
+	// of the files in it, and the directories keep their own.
+	Mode os.FileMode
+	// ConfirmOverwrite is asked before an existing file is overwritten. If it
+	// says no (or is nil) we leave the file alone and return an error wrapping
+	// ErrDestinationExists.
+	ConfirmOverwrite func(dstPath string) bool
+}
+
+// BindAll binds each set among the horcruxes at the given paths that has
+// enough horcruxes to resurrect its original file, and lists the sets that
+// don't.
+func BindAll(paths []string, options BindOptions) error {
+	sets, err := getSelectedHorcruxSets(paths, options.Selection)
+	if err != nil {
+		return err
+	}
+
+	if options.OutputDir != "" {
+		if err := os.MkdirAll(options.OutputDir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	if len(sets) <= 1 || options.OutputPath != "" {
+		horcruxes, err := singleSet(sets, "-o")
+		if err != nil {
+			return err
+		}
+		return bindSetWithConfirmation(horcruxes, options)
+	}
+
+	dstPaths := bindDestinations(sets, options.OutputDir)
+
+	// if any set fails, the error we return wraps the first failure, so that
+	// the caller can tell what kind of failure it was
+	bound := 0
+	failed := 0
+	var firstErr error
+	for i, set := range sets {
+		header := set[0].GetHeader()
+		if len(set) < header.Threshold {
+			fmt.Fprintf(Messages, "skipping %s: have %d of %d required horcruxes\n", describeSet(set), len(set), header.Threshold)
+			if firstErr == nil {
+				firstErr = &NotEnoughHorcruxesError{Have: len(set), Required: header.Threshold}
+			}
+			continue
+		}
+
+		setOptions := options
+		setOptions.OutputPath = dstPaths[i]
+		if filepath.Base(dstPaths[i]) != header.OriginalFilename {
+			fmt.Fprintf(Messages, "binding %s to %s, as there's more than one set with that name\n", describeSet(set), dstPaths[i])
+		} else {
+			fmt.Fprintf(Messages, "binding %s\n", describeSet(set))
+		}
+		if err := bindSetWithConfirmation(set, setOptions); err != nil {
+			if errors.Is(err, ErrDestinationExists) {
+				fmt.Fprintf(Messages, "skipping %s: %s\n", describeSet(set), err)
+			} else {
+				fmt.Fprintf(Messages, "could not bind %s: %s\n", describeSet(set), err)
+			}
+			if failed == 0 {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		bound++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of the %d sets of horcruxes could not be bound: %w", failed, len(sets), firstErr)
+	}
+	if bound == 0 {
+		return fmt.Errorf("none of the sets of horcruxes could be bound: %w", firstErr)
+	}
+
+	return nil
+}
+
+// bindDestinations returns the path to bind each set to in outputDir. Sets are
+// bound under their original filenames, but if more than one set has the same
+// name (because the same file was split more than once, say), each of those is
+// told apart by its set ID, so that binding one doesn't overwrite another.
+func bindDestinations(sets [][]Horcrux, outputDir string) []string {
+	counts := map[string]int{}
+	for _, set := range sets {
+		counts[set[0].GetHeader().OriginalFilename]++
+	}
+
+	dstPaths := make([]string, len(sets))
+	for i, set := range sets {
+		header := set[0].GetHeader()
+		name := header.OriginalFilename
+		if counts[name] > 1 {
+			name = nameWithSetID(header)
+		}
+		dstPaths[i] = filepath.Join(outputDir, name)
+	}
+	return dstPaths
+}
+
+// nameWithSetID returns the header's original filename with its (short) set
+// ID, or for sets without one the time they were split, before the extension.
+// The set ID comes from the header like the filename does, so we make sure it
+// can't take the name out of the directory we bind into.
+func nameWithSetID(header HorcruxHeader) string {
+	id := shortSetID(header.SetID)
+	if id == "" || validateOriginalFilename(id) != nil {
+		id = time.Unix(header.Timestamp, 0).Format("20060102-150405")
+	}
+
+	name := header.OriginalFilename
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), id, ext)
+}
+
+// BindToWriter resurrects the original file from the horcruxes at the given
+// paths and writes it to w. There must only be one set of horcruxes among
+// them, unless selection picks one out (see SelectHorcruxSet). Nothing is
+// written to disk, but if the horcruxes turn out to be corrupt, part of the
+// original file may have been written to w by the time we return an error.
+func BindToWriter(paths []string, selection string, w io.Writer) error {
+	sets, err := getSelectedHorcruxSets(paths, selection)
+	if err != nil {
+		return err
+	}
+
+	horcruxes, err := singleSet(sets, "-stdout")
+	if err != nil {
+		return err
+	}
+
+	if err := openHorcruxes(horcruxes); err != nil {
+		return err
+	}
+	defer closeHorcruxes(horcruxes)
+
+	reader, err := resurrect(horcruxes)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// singleSet returns the only set of horcruxes, or an error explaining that
+// the user has to pick one if there are several, because of the given flag.
+// If there are none, we return none and leave it to ValidateHorcruxes to
+// complain.
+func singleSet(sets [][]Horcrux, flag string) ([]Horcrux, error) {
+	switch len(sets) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sets[0], nil
+	default:
+		descriptions := make([]string, len(sets))
+		for i, set := range sets {
+			descriptions[i] = describeSet(set)
+		}
+		return nil, fmt.Errorf("found %d sets of horcruxes but %s can only be used to bind one of them, please choose one with -set:\n%s", len(sets), flag, strings.Join(descriptions, "\n"))
+	}
+}
+
+// getSelectedHorcruxSets returns the sets of horcruxes at the given paths, or
+// just the one picked out by selection if it isn't empty
+func getSelectedHorcruxSets(paths []string, selection string) ([][]Horcrux, error) {
+	sets, err := GetHorcruxSets(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if selection == "" {
+		return sets, nil
+	}
+
+	if len(sets) == 0 {
+		return nil, &NotEnoughHorcruxesError{}
+	}
+	set, err := SelectHorcruxSet(sets, selection)
+	if err != nil {
+		return nil, err
+	}
+	return [][]Horcrux{set}, nil
+}
+
+func bindSetWithConfirmation(horcruxes []Horcrux, options BindOptions) error {
 	if err := ValidateHorcruxes(horcruxes); err != nil {
 		return err
 	}
 
-	firstHorcrux := horcruxes[0]
+	dstPath := options.OutputPath
+	if dstPath == "" {
+		dstPath = filepath.Join(options.OutputDir, horcruxes[0].GetHeader().OriginalFilename)
+	}
+
+	err := bindSet(horcruxes, dstPath, false, options)
+	if err != os.ErrExist {
+		return err
+	}
+
+	if options.ConfirmOverwrite == nil || !options.ConfirmOverwrite(dstPath) {
+		return fmt.Errorf("not overwriting %s: %w", dstPath, ErrDestinationExists)
+	}
+
+	return bindSet(horcruxes, dstPath, true, options)
+}
 
-	// if dstPath is empty we use the original filename
+// bindSet resurrects the original file from the given set of horcruxes,
+// returning os.ErrExist if there's already a file at dstPath and we haven't
+// been told to overwrite it. If the horcruxes recorded the original file's
+// permissions, modification time and owner, those are restored too, unless
+// options say otherwise.
+func bindSet(horcruxes []Horcrux, dstPath string, overwrite bool, options BindOptions) error {
+	if err := ValidateHorcruxes(horcruxes); err != nil {
+		return err
+	}
+
+	// if dstPath is empty we use the original filename, in the current
+	// directory
 	if dstPath == "" {
-		cwd, err := os.Getwd()
+		dstPath = horcruxes[0].GetHeader().OriginalFilename
+	}
+
+	if horcruxes[0].GetHeader().Archive != "" {
+		return bindDirectory(horcruxes, dstPath, overwrite, options)
+	}
+
+	if fileExists(dstPath) && !overwrite {
+		return os.ErrExist
+	}
+
+	warnIfWritableByOthers(filepath.Dir(dstPath))
+
+	return resurrectWithSpares(horcruxes, func(reader *checkedReader) error {
+		// we write to a temp file and only move it into place once the whole
+		// of the original file has been resurrected and checked, so if the
+		// horcruxes turn out to be corrupt, whatever was at dstPath is left as
+		// it was.
+		newFile, err := createAtomicFile(dstPath, DefaultFileMode)
 		if err != nil {
 			return err
 		}
-		dstPath = filepath.Join(cwd, firstHorcrux.GetHeader().OriginalFilename)
+
+		if _, err := io.Copy(newFile, reader); err != nil {
+			newFile.Abort()
+			return err
+		}
+
+		if reader.fileInfo != nil {
+			if err := reader.fileInfo.restore(newFile.File, dstPath, options.SkipOwner); err != nil {
+				newFile.Abort()
+				return err
+			}
+		}
+
+		if options.Mode != 0 {
+			if err := newFile.Chmod(options.Mode); err != nil {
+				newFile.Abort()
+				return err
+			}
+		}
+
+		return newFile.Commit()
+	})
+}
+
+// bindDirectory is bindSet for a set whose original was a directory. The
+// directory is recreated next to dstPath and only moved into place once all of
+// it has been resurrected and checked, replacing whatever was at dstPath if
+// we've been told to overwrite it.
+func bindDirectory(horcruxes []Horcrux, dstPath string, overwrite bool, options BindOptions) error {
+	if archive := horcruxes[0].GetHeader().Archive; archive != ArchiveTar {
+		return fmt.Errorf("unknown archive format %q", archive)
 	}
 
-	if fileExists(dstPath) && !overwrite {
+	if _, err := os.Lstat(dstPath); err == nil && !overwrite {
 		return os.ErrExist
 	}
 
-	keyFragments := make([][]byte, len(horcruxes))
-	for i := range keyFragments {
-		keyFragments[i] = horcruxes[i].GetHeader().KeyFragment
+	warnIfWritableByOthers(filepath.Dir(dstPath))
+
+	return resurrectWithSpares(horcruxes, func(reader *checkedReader) error {
+		tmpDir, err := ioutil.TempDir(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".*.tmp")
+		if err != nil {
+			return err
+		}
+
+		if err := extractTarArchive(reader, tmpDir, dstPath, options); err != nil {
+			removeAllWithin(tmpDir)
+			return err
+		}
+
+		// the archive ends before the stream does, and it's only at the very
+		// end of the stream that we find out whether we got back what was split
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			removeAllWithin(tmpDir)
+			return err
+		}
+
+		if reader.fileInfo != nil {
+			dir, err := os.Open(tmpDir)
+			if err == nil {
+				err = reader.fileInfo.restore(dir, dstPath, options.SkipOwner)
+				dir.Close()
+			}
+			if err != nil {
+				removeAllWithin(tmpDir)
+				return err
+			}
+		}
+
+		if err := replaceWithDirectory(tmpDir, dstPath); err != nil {
+			removeAllWithin(tmpDir)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// resurrect returns a reader of the original file's contents as resurrected
+// from the given set of horcruxes, which must have been opened
+func resurrect(horcruxes []Horcrux) (*checkedReader, error) {
+	if err := ValidateHorcruxes(horcruxes); err != nil {
+		return nil, err
 	}
 
-	key, err := shamir.Combine(keyFragments)
+	key, err := combineKeyWithReport(horcruxes)
 	if err != nil {
+		return nil, err
+	}
+
+	return originalContentReader(horcruxes, key)
+}
+
+// resurrectWithSpares resurrects the original file from the given set of
+// horcruxes and passes the reader to use, returning whatever error use does.
+// An erasure coded body is only read from `threshold` of the horcruxes, so if
+// one of those turns out to be corrupt and we have others to spare, we try
+// again without it. use has to clean up after itself when it fails, because
+// it might be called again. The horcruxes' files are only open until we return.
+func resurrectWithSpares(horcruxes []Horcrux, use func(reader *checkedReader) error) error {
+	if err := openHorcruxes(horcruxes); err != nil {
 		return err
 	}
+	defer closeHorcruxes(horcruxes)
+
+	for {
+		reader, err := resurrect(horcruxes)
+		if err != nil {
+			return err
+		}
+
+		err = use(reader)
+		if err == nil {
+			return nil
+		}
+
+		header := horcruxes[0].GetHeader()
+		var corruptErr *CorruptHorcruxError
+		if header.bodyMode() != BodyModeErasure || len(horcruxes) <= header.Threshold || !errors.As(err, &corruptErr) {
+			return err
+		}
 
+		remaining := []Horcrux{}
+		for _, horcrux := range horcruxes {
+			if horcrux.GetPath() != corruptErr.Path {
+				remaining = append(remaining, horcrux)
+			}
+		}
+		if len(remaining) == len(horcruxes) {
+			return err
+		}
+
+		for i := range remaining {
+			if err := remaining[i].rewind(); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(Messages, "%s, so trying again without it\n", err)
+		horcruxes = remaining
+	}
+}
+
+// originalContentReader returns a reader of the original file's contents
+// as resurrected from the given (already validated) horcruxes and the key
+// combined from them. Nothing is written to disk.
+func originalContentReader(horcruxes []Horcrux, key []byte) (*checkedReader, error) {
+	firstHorcrux := horcruxes[0]
+
+	format, err := getFormat(firstHorcrux.GetHeader().Version)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := deriveKeys(key, firstHorcrux.GetHeader())
+	if err != nil {
+		return nil, err
+	}
+
+	var bodies []*bodyReader
 	var fileReader io.Reader
-	if firstHorcrux.GetHeader().Total == firstHorcrux.GetHeader().Threshold {
-		horcruxFiles := make([]*os.File, len(horcruxes))
+	switch firstHorcrux.GetHeader().bodyMode() {
+	case BodyModeStriped:
+		readers := make([]io.Reader, len(horcruxes))
 		for i, horcrux := range horcruxes {
-			horcruxFiles[i] = horcrux.GetFile()
+			body := newBodyReader(horcrux, keys.mac)
+			bodies = append(bodies, body)
+			readers[i] = body
 		}
 
-		fileReader = &multiplexing.Multiplexer{Readers: horcruxFiles}
-	} else {
-		fileReader = firstHorcrux.GetFile() // arbitrarily read from the first horcrux: they all contain the same contents
-	}
+		fileReader = &multiplexing.Multiplexer{Readers: readers, StripeSize: format.stripeSize}
+	case BodyModeFullCopy:
+		if format.bodyCipher == BodyCipherAESGCMChunked {
+			return repairingContentReader(horcruxes, keys)
+		}
 
-	reader := cryptoReader(fileReader, key)
+		body := newBodyReader(firstHorcrux, keys.mac) // arbitrarily read from the first horcrux: they all contain the same contents
+		bodies = append(bodies, body)
+		fileReader = body
+	case BodyModeErasure:
+		if err := checkErasureSizes(horcruxes, format); err != nil {
+			return nil, err
+		}
 
-	_ = os.Truncate(dstPath, 0)
+		// any `threshold` horcruxes will do, so we'll go with the first ones.
+		readers := make([]io.Reader, firstHorcrux.GetHeader().Total)
+		for _, horcrux := range horcruxes[:firstHorcrux.GetHeader().Threshold] {
+			body := newBodyReader(horcrux, keys.mac)
+			bodies = append(bodies, body)
+			readers[horcrux.GetHeader().Index-1] = body
+		}
 
-	newFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE, 0644)
+		fileReader, err = erasure.NewDecoder(readers, firstHorcrux.GetHeader().Threshold, format.stripeSize, firstHorcrux.GetHeader().EncryptedSize)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown body mode %q", firstHorcrux.GetHeader().bodyMode())
+	}
+
+	reader, err := bodyDecrypter(fileReader, keys, format, firstHorcrux.GetHeader())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer newFile.Close()
 
-	_, err = io.Copy(newFile, reader)
+	return newCheckedReader(reader, bodies, keys, firstHorcrux.GetHeader())
+}
+
+// checkErasureSizes makes sure that the size of the encrypted file in each
+// horcrux's header fits with the size of its body. Headers aren't
+// authenticated, so otherwise a bad size would only be caught once we'd
+// decoded as far as it, if at all.
+func checkErasureSizes(horcruxes []Horcrux, format format) error {
+	for _, horcrux := range horcruxes {
+		header := horcrux.GetHeader()
+		if header.EncryptedSize < 0 {
+			return &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its header says the encrypted file is %d bytes", header.EncryptedSize)}
+		}
+		if expected := erasure.ShardSize(header.Index-1, header.Threshold, format.stripeSize, header.EncryptedSize); expected != header.BodySize {
+			return &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its header says the encrypted file is %d bytes, which would make its body %d bytes, not %d", header.EncryptedSize, expected, header.BodySize)}
+		}
+	}
+	return nil
+}
+
+// repairingContentReader reads the body from the first horcrux, but because
+// every horcrux holds a full copy of it, any chunk that's damaged in the first
+// horcrux can be taken from another one instead.
+func repairingContentReader(horcruxes []Horcrux, keys keys) (*checkedReader, error) {
+	copies := make([]io.ReaderAt, len(horcruxes))
+	for i, horcrux := range horcruxes {
+		copies[i] = horcrux.GetBody()
+	}
+
+	onRepair := func(chunk int, from int) {
+		fmt.Fprintf(Messages, "chunk %d of %s is damaged so we've used the copy from %s\n", chunk, horcruxes[0].GetPath(), horcruxes[from].GetPath())
+	}
+
+	header := horcruxes[0].GetHeader()
+	reader, err := encryption.NewRepairingDecrypter(copies, keys.body, header.NoncePrefix, onRepair)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return err
+	// we don't check the digest of each horcrux's body here: the chunks
+	// themselves are authenticated and we expect some of them to be damaged.
+	return newCheckedReader(reader, nil, keys, header)
+}
+
+func bodyDecrypter(r io.Reader, keys keys, format format, header HorcruxHeader) (io.Reader, error) {
+	if header.BodyCipher != format.bodyCipher {
+		return nil, fmt.Errorf("unexpected body cipher %q for horcrux format version %d", header.BodyCipher, header.Version)
+	}
+
+	switch format.bodyCipher {
+	case "":
+		return cryptoReader(r, keys.body), nil
+	case BodyCipherAESGCMChunked:
+		return encryption.NewDecrypter(r, keys.body, header.NoncePrefix)
+	default:
+		return nil, fmt.Errorf("unknown body cipher %q", format.bodyCipher)
+	}
 }
@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBindExample(t *testing.T) {
+	Messages = ioutil.Discard
+
+	paths, err := GetHorcruxPathsInDir("../../example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile("../../example/diary.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bound bytes.Buffer
+	if err := BindToWriter(paths, "", &bound); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bound.Bytes(), expected) {
+		t.Errorf("bound example does not match diary.txt:\n%s", bound.Bytes())
+	}
+}
+
+func TestSplitBindRoundTrip(t *testing.T) {
+	Messages = ioutil.Discard
+
+	// long enough for several stripes and chunks, and not a multiple of either
+	content := make([]byte, 200*1024+7)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	cases := []struct {
+		name     string
+		options  SplitOptions
+		bodyMode string
+	}{
+		{name: "striped", options: SplitOptions{Total: 3, Threshold: 3}, bodyMode: BodyModeStriped},
+		{name: "full copy", options: SplitOptions{Total: 5, Threshold: 3, FullCopy: true}, bodyMode: BodyModeFullCopy},
+		{name: "erasure", options: SplitOptions{Total: 5, Threshold: 3}, bodyMode: BodyModeErasure},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "horcrux-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			original := filepath.Join(dir, "diary.txt")
+			if err := ioutil.WriteFile(original, content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := Split(original, dir, c.options); err != nil {
+				t.Fatal(err)
+			}
+
+			paths := make([]string, c.options.Total)
+			for i := range paths {
+				paths[i] = filepath.Join(dir, horcruxFilename("diary.txt", i+1, c.options.Total))
+			}
+
+			horcruxes, err := GetHorcruxes(paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(horcruxes) != c.options.Total {
+				t.Fatalf("expected %d horcruxes, got %d", c.options.Total, len(horcruxes))
+			}
+			if bodyMode := horcruxes[0].GetHeader().BodyMode; bodyMode != c.bodyMode {
+				t.Errorf("expected body mode %q, got %q", c.bodyMode, bodyMode)
+			}
+
+			// all of the horcruxes, and just enough of them from the end
+			subsets := [][]string{paths, paths[c.options.Total-c.options.Threshold:]}
+			for i, subset := range subsets {
+				dstPath := filepath.Join(dir, fmt.Sprintf("bound-%d.txt", i))
+				if err := BindAll(subset, BindOptions{OutputPath: dstPath}); err != nil {
+					t.Fatalf("binding %d horcruxes: %s", len(subset), err)
+				}
+				bound, err := ioutil.ReadFile(dstPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(bound, content) {
+					t.Errorf("binding %d horcruxes: bound file does not match the original", len(subset))
+				}
+			}
+		})
+	}
+}
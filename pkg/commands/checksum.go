@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/jesseduffield/horcrux/pkg/encryption"
+)
+
+// Each horcrux records the size and digest of its own body in its header
+// (an HMAC under the MAC key, so that it can't be forged along with the body),
+// so that when something goes wrong we can name the exact horcrux
+// that is corrupt or truncated rather than just failing to decrypt.
+
+type CorruptHorcruxError struct {
+	Path    string
+	Problem string
+}
+
+func (e *CorruptHorcruxError) Error() string {
+	return fmt.Sprintf("%s is corrupt: %s", e.Path, e.Problem)
+}
+
+// bodyWriter tallies up the size and digest of a horcrux's body as it's written
+type bodyWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newBodyWriter(w io.Writer, macKey []byte) *bodyWriter {
+	return &bodyWriter{w: w, hash: newBodyHash(macKey)}
+}
+
+// newBodyHash returns the hash a body's digest is taken with
+func newBodyHash(macKey []byte) hash.Hash {
+	return hmac.New(sha256.New, macKey)
+}
+
+func (b *bodyWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	b.hash.Write(p[:n])
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *bodyWriter) digest() []byte {
+	return b.hash.Sum(nil)
+}
+
+// bodyReader checks a horcrux's body against the size and digest in its header
+// as it's read, returning a CorruptHorcruxError once it reaches the end if the
+// two don't match. v1 horcruxes don't record digests, so they go unchecked.
+type bodyReader struct {
+	horcrux Horcrux
+	hash    hash.Hash
+	size    int64
+	err     error
+}
+
+func newBodyReader(horcrux Horcrux, macKey []byte) *bodyReader {
+	return &bodyReader{horcrux: horcrux, hash: newBodyHash(macKey)}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n, err := b.horcrux.GetFile().Read(p)
+	b.hash.Write(p[:n])
+	b.size += int64(n)
+
+	header := b.horcrux.GetHeader()
+	if header.BodyDigest == nil {
+		return n, err
+	}
+
+	if b.size > header.BodySize {
+		b.err = b.corrupt(fmt.Sprintf("its body is longer than the %d bytes recorded in its header", header.BodySize))
+		return n, b.err
+	}
+
+	if err == io.EOF {
+		if b.size < header.BodySize {
+			b.err = b.corrupt(fmt.Sprintf("it is truncated: its body is %d bytes but its header says it should be %d", b.size, header.BodySize))
+			return n, b.err
+		}
+		if !bytes.Equal(b.hash.Sum(nil), header.BodyDigest) {
+			b.err = b.corrupt("its body does not match the digest recorded in its header")
+			return n, b.err
+		}
+	}
+
+	return n, err
+}
+
+// check reads whatever is left of the body and returns an error if it doesn't
+// match its header.
+func (b *bodyReader) check() error {
+	_, err := io.Copy(ioutil.Discard, b)
+	return err
+}
+
+func (b *bodyReader) corrupt(problem string) error {
+	return &CorruptHorcruxError{Path: b.horcrux.GetPath(), Problem: problem}
+}
+
+// ErrContentMismatch is returned when the resurrected content doesn't match the
+// digest of the original content taken at split time.
+var ErrContentMismatch = errors.New("the resurrected file does not match the original file that was split")
+
+// checkedReader wraps the decrypted stream of one or more horcrux bodies. If
+// decryption fails, it checks each body so that it can point the finger at the
+// horcrux responsible, and once the stream is done it makes sure that every
+// body was read in its entirety and that the decrypted content matches the
+// digest of the original content.
+type checkedReader struct {
+	r             io.Reader
+	bodies        []*bodyReader
+	contentHash   hash.Hash
+	contentDigest []byte
+	// fileInfo is what the header says about the original file, if anything
+	fileInfo *originalFileInfo
+}
+
+func newCheckedReader(r io.Reader, bodies []*bodyReader, keys keys, header HorcruxHeader) (*checkedReader, error) {
+	reader := &checkedReader{r: r, bodies: bodies, contentHash: sha256.New()}
+
+	// v1 horcruxes don't record a content digest, so they go unchecked
+	if header.SealedContentDigest != nil {
+		contentDigest, err := encryption.OpenMetadata(keys.metadata, header.NoncePrefix, header.SealedContentDigest)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt the content digest: %w", err)
+		}
+		reader.contentDigest = contentDigest
+	}
+
+	fileInfo, err := openFileInfo(keys, header)
+	if err != nil {
+		return nil, err
+	}
+	reader.fileInfo = fileInfo
+
+	return reader, nil
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.contentHash.Write(p[:n])
+	if err == nil {
+		return n, nil
+	}
+
+	if _, ok := err.(*CorruptHorcruxError); ok {
+		return n, err
+	}
+
+	for _, body := range c.bodies {
+		if checkErr := body.check(); checkErr != nil {
+			return n, checkErr
+		}
+	}
+
+	if err == io.EOF && c.contentDigest != nil && !bytes.Equal(c.contentHash.Sum(nil), c.contentDigest) {
+		return n, ErrContentMismatch
+	}
+
+	return n, err
+}
+
+// corruptBodies returns an error for each body that doesn't match its header
+func (c *checkedReader) corruptBodies() []error {
+	errs := []error{}
+	for _, body := range c.bodies {
+		if err := body.check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (c *checkedReader) usesBodyOf(horcrux Horcrux) bool {
+	for _, body := range c.bodies {
+		if body.horcrux.GetPath() == horcrux.GetPath() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultMaxDepth is how many levels of subdirectories we look for horcruxes
+// in unless told otherwise
+const DefaultMaxDepth = 10
+
+// DiscoveryOptions controls how FindHorcruxPaths looks for horcruxes
+type DiscoveryOptions struct {
+	// MaxDepth is how many levels of subdirectories to look in below each
+	// given directory: 0 means just the directory itself.
+	MaxDepth int
+	// FollowSymlinks makes us follow symlinks we come across while looking
+	// through directories. Otherwise we skip them, so that we can't end up
+	// going round in circles or wandering off into some other part of the
+	// filesystem. Paths we're given directly are always followed.
+	FollowSymlinks bool
+}
+
+// FindHorcruxPaths returns the paths of the horcruxes at the given locations.
+// A location that's a file is taken to be a horcrux, and a location that's a
+// directory is searched for files with the .horcrux extension, recursively
+// down to options.MaxDepth. Subdirectories we can't read are skipped with a
+// warning, because one unreadable folder on a network share shouldn't stop us
+// from finding the horcruxes in the rest of it.
+func FindHorcruxPaths(locations []string, options DiscoveryOptions) ([]string, error) {
+	finder := &horcruxFinder{options: options, visited: map[string]bool{}, found: map[string]bool{}}
+
+	for _, location := range locations {
+		info, err := os.Stat(location)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			finder.add(location)
+			continue
+		}
+
+		if err := finder.search(location, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return finder.paths, nil
+}
+
+type horcruxFinder struct {
+	options DiscoveryOptions
+	// visited holds the real paths of the directories we've searched, so that
+	// we search each one once no matter how many ways there are to reach it.
+	visited map[string]bool
+	found   map[string]bool
+	paths   []string
+}
+
+func (f *horcruxFinder) add(path string) {
+	path = filepath.Clean(path)
+	if f.found[path] {
+		return
+	}
+	f.found[path] = true
+	f.paths = append(f.paths, path)
+}
+
+func (f *horcruxFinder) search(dir string, depth int) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if f.visited[realDir] {
+		return nil
+	}
+	f.visited[realDir] = true
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if !f.options.FollowSymlinks {
+				continue
+			}
+			entry, err = os.Stat(path)
+			if err != nil {
+				// a dangling symlink can't be a horcrux
+				continue
+			}
+		}
+
+		if entry.IsDir() {
+			if depth >= f.options.MaxDepth {
+				continue
+			}
+			if err := f.search(path, depth+1); err != nil {
+				fmt.Fprintf(Messages, "skipping %s: %s\n", path, err)
+			}
+			continue
+		}
+
+		if entry.Mode().IsRegular() && filepath.Ext(entry.Name()) == ".horcrux" {
+			f.add(path)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jesseduffield/horcrux/pkg/encryption"
+)
+
+// Scripts need to tell why a command failed, so the failures they might want
+// to react to each have an error that can be picked out with errors.Is or
+// errors.As, however deeply it's wrapped.
+
+// NotEnoughHorcruxesError is returned when there aren't enough horcruxes to
+// resurrect the original file
+type NotEnoughHorcruxesError struct {
+	Have     int
+	Required int
+}
+
+func (e *NotEnoughHorcruxesError) Error() string {
+	if e.Have == 0 {
+		return "No horcruxes supplied"
+	}
+	return fmt.Sprintf("You do not have all the required horcruxes. There are %d required to resurrect the original file. You only have %d", e.Required, e.Have)
+}
+
+// ErrBadKeyFragments is returned when the key fragments of a set of horcruxes
+// don't combine into the right key, because some have been corrupted
+var ErrBadKeyFragments = errors.New("the key fragments are corrupt")
+
+// ErrUnsafeArchive is returned when a directory's archive names a path outside
+// of the directory. Split never does that, so the archive wasn't made by us.
+var ErrUnsafeArchive = errors.New("the archive holds an unsafe path")
+
+// ErrDestinationExists is returned when we won't overwrite an existing file
+var ErrDestinationExists = errors.New("destination already exists")
+
+// IsIntegrityError tells us whether the error means that a horcrux is corrupt
+// or has been tampered with
+func IsIntegrityError(err error) bool {
+	var corruptErr *CorruptHorcruxError
+	return errors.As(err, &corruptErr) ||
+		errors.Is(err, ErrContentMismatch) ||
+		errors.Is(err, ErrBadKeyFragments) ||
+		errors.Is(err, ErrUnsafeArchive) ||
+		errors.Is(err, ErrVerificationFailed) ||
+		errors.Is(err, encryption.ErrCorrupt) ||
+		errors.Is(err, encryption.ErrTruncated) ||
+		errors.Is(err, encryption.ErrTrailingData)
+}
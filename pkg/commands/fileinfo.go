@@ -0,0 +1,93 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jesseduffield/horcrux/pkg/encryption"
+)
+
+// originalFileInfo is what we know about the original file besides its name
+// and contents, so that bind can give it back the permissions, modification
+// time and owner it had when it was split. It's sealed in the header rather
+// than stored in plain sight, because it says more about the file than
+// anybody who finds a horcrux needs to know.
+type originalFileInfo struct {
+	// Mode holds just the permission bits. We don't restore setuid and the like
+	// from a file that could have come from anywhere.
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+	// UID and GID are missing on platforms without them, like Windows
+	UID *int `json:"uid,omitempty"`
+	GID *int `json:"gid,omitempty"`
+}
+
+func newOriginalFileInfo(info os.FileInfo) *originalFileInfo {
+	uid, gid := fileOwner(info)
+	return &originalFileInfo{
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime(),
+		UID:     uid,
+		GID:     gid,
+	}
+}
+
+// sealFileInfo encrypts the file info for the header. It has a key of its own
+// because only one piece of metadata can be sealed with each key and nonce
+// prefix, and the metadata key is taken by the content digest.
+func sealFileInfo(fileInfo *originalFileInfo, keys keys, noncePrefix []byte) ([]byte, error) {
+	if fileInfo == nil || keys.fileInfo == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(fileInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryption.SealMetadata(keys.fileInfo, noncePrefix, data)
+}
+
+// openFileInfo decrypts the file info in the header, returning nil if there
+// isn't any (as is the case for horcruxes made from stdin, and v1 horcruxes)
+func openFileInfo(keys keys, header HorcruxHeader) (*originalFileInfo, error) {
+	if header.SealedFileInfo == nil || keys.fileInfo == nil {
+		return nil, nil
+	}
+
+	data, err := encryption.OpenMetadata(keys.fileInfo, header.NoncePrefix, header.SealedFileInfo)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the original file's details: %w", err)
+	}
+
+	fileInfo := &originalFileInfo{}
+	if err := json.Unmarshal(data, fileInfo); err != nil {
+		return nil, fmt.Errorf("could not read the original file's details: %w", err)
+	}
+
+	return fileInfo, nil
+}
+
+// restore gives the file (which will end up at path) the permissions, modification time and, unless
+// skipOwner is set, the owner of the original file. Only the superuser can
+// give a file away to somebody else, so failing to restore the owner is just
+// a warning.
+func (i *originalFileInfo) restore(file *os.File, path string, skipOwner bool) error {
+	if !skipOwner && i.UID != nil && i.GID != nil {
+		if err := file.Chown(*i.UID, *i.GID); err != nil {
+			// the error names the temp file, which means nothing to the user
+			if pathErr, ok := err.(*os.PathError); ok {
+				err = pathErr.Err
+			}
+			fmt.Fprintf(Messages, "could not give %s its original owner (pass -no-owner to not try): %s\n", path, err)
+		}
+	}
+
+	if err := file.Chmod(i.Mode.Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(file.Name(), time.Now(), i.ModTime)
+}
@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jesseduffield/horcrux/pkg/multiplexing"
+)
+
+// Every horcrux records the version of the file format it was written in, so
+// that we can change how bodies are encrypted or laid out without stranding
+// the horcruxes people have already hidden around the house. Horcruxes made
+// before we started versioning have no version in their header and are v1.
+//
+// v1: body encrypted with AES-OFB (zero IV, no authentication), striped in
+// 100 byte stripes when threshold == total and a full copy in every horcrux
+// otherwise. The key is split with regular shamir over GF(2^8) and used as is.
+// v2: separate keys for encrypting the body, sealing metadata and
+// authenticating each horcrux's body are derived with HKDF from a key that's
+// split with Feldman's verifiable secret sharing, with the commitments for
+// verifying key fragments stored in the header. The body is encrypted with
+// chunked AES-GCM and striped in 4096 byte stripes, copied in full or erasure
+// coded, as recorded in the header along with a digest of each horcrux's body
+// and the sealed digest of the original file. The original's permissions and
+// the like may be sealed in the header too, and it may be a directory, in
+// which case the header says what it was archived in.
+//
+// Whenever you change anything that would stop an older version of horcrux
+// from correctly reading a new horcrux, add a new version here and bump
+// CurrentVersion. Never change the meaning of an existing version.
+
+// CurrentVersion is the format version that new horcruxes are written in
+const CurrentVersion = 2
+
+const legacyVersion = 1
+
+type format struct {
+	bodyCipher    string
+	stripeSize    int
+	keyScheme     string
+	keyDerivation string
+}
+
+var formats = map[int]format{
+	1: {bodyCipher: "", stripeSize: multiplexing.BYTE_QUOTA},
+	2: {bodyCipher: BodyCipherAESGCMChunked, stripeSize: 4096, keyScheme: KeySchemeFeldman, keyDerivation: KeyDerivationHKDF},
+}
+
+// Key fragments are regular shamir shares over GF(2^8) unless the header says
+// otherwise.
+const KeySchemeFeldman = "feldman-modp2048"
+
+// The key is used as is unless the header says otherwise.
+const KeyDerivationHKDF = "hkdf-sha256"
+
+// How the encrypted body is laid out across the horcruxes of a set
+const (
+	// each horcrux holds its share of the body, in stripes. Used when every
+	// horcrux is required to bind.
+	BodyModeStriped = "striped"
+	// each horcrux holds a full copy of the body
+	BodyModeFullCopy = "full-copy"
+	// the body is striped across the first `threshold` horcruxes and the rest
+	// hold Reed-Solomon parity, so that any `threshold` of them can recover it.
+	BodyModeErasure = "erasure"
+)
+
+// bodyMode returns how the horcrux's body is laid out. v1 horcruxes don't
+// record it in the header: they were striped when every horcrux was required
+// and full copies otherwise.
+func (h HorcruxHeader) bodyMode() string {
+	if h.BodyMode != "" {
+		return h.BodyMode
+	}
+	if h.Total == h.Threshold {
+		return BodyModeStriped
+	}
+	return BodyModeFullCopy
+}
+
+func getFormat(version int) (format, error) {
+	f, ok := formats[version]
+	if !ok {
+		if version > CurrentVersion {
+			return format{}, fmt.Errorf("horcrux format version %d was made by a newer version of horcrux. Please upgrade horcrux to bind it", version)
+		}
+		return format{}, fmt.Errorf("unknown horcrux format version %d", version)
+	}
+	return f, nil
+}
+
+// checkFormat makes sure that the horcrux's header has everything that its
+// format version always records. v1 recorded next to nothing, but from v2 on
+// a header that's missing something (or that says the body was encrypted some
+// other way) has been tampered with, and we'd rather say so than quietly skip
+// whatever check the missing field was there for.
+func checkFormat(horcrux Horcrux) error {
+	header := horcrux.GetHeader()
+	format, err := getFormat(header.Version)
+	if err != nil {
+		return err
+	}
+
+	if header.KeyScheme != format.keyScheme || header.KeyDerivation != format.keyDerivation || header.BodyCipher != format.bodyCipher ||
+		(header.Version == legacyVersion && header.BodyMode != "") {
+		return &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its header has a key scheme, key derivation, body cipher or body mode that format version %d doesn't use", header.Version)}
+	}
+	if header.Version == legacyVersion {
+		return nil
+	}
+
+	missing := []string{}
+	if header.SetID == "" {
+		missing = append(missing, "a set ID")
+	}
+	if header.BodyMode == "" {
+		missing = append(missing, "a body mode")
+	}
+	if len(header.Commitments) == 0 {
+		missing = append(missing, "key fragment commitments")
+	}
+	if header.BodyDigest == nil {
+		missing = append(missing, "a body digest")
+	}
+	if header.SealedContentDigest == nil {
+		missing = append(missing, "a content digest")
+	}
+	if len(missing) > 0 {
+		return &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its header is missing %s, which format version %d always records", strings.Join(missing, ", "), header.Version)}
+	}
+
+	return nil
+}
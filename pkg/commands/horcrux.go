@@ -4,42 +4,149 @@ import (
 	"bufio"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// v1 horcruxes don't record the body cipher in the header: their body is
+// encrypted with AES-OFB (see cryptoReader) and BodyCipher is empty.
+const BodyCipherAESGCMChunked = "aes-256-gcm-chunked"
+
 type HorcruxHeader struct {
+	Version int `json:"version,omitempty"`
+	// SetID is random and shared by every horcrux made by the same split
+	SetID            string `json:"setId,omitempty"`
 	OriginalFilename string `json:"originalFilename"`
 	Timestamp        int64  `json:"timestamp"`
 	Index            int    `json:"index"`
 	Total            int    `json:"total"`
 	Threshold        int    `json:"threshold"`
 	KeyFragment      []byte `json:"keyFragment"`
+	KeyScheme        string `json:"keyScheme,omitempty"`
+	// Commitments allow each key fragment to be verified on its own. They're
+	// the same for every horcrux in the set.
+	Commitments   [][]byte `json:"commitments,omitempty"`
+	KeyDerivation string   `json:"keyDerivation,omitempty"`
+	// KeyDerivationSalt is the random salt the keys for each purpose are
+	// derived from the key with. It's the same for every horcrux in the set.
+	KeyDerivationSalt []byte `json:"keyDerivationSalt,omitempty"`
+	BodyCipher        string `json:"bodyCipher,omitempty"`
+	NoncePrefix       []byte `json:"noncePrefix,omitempty"`
+	BodyMode          string `json:"bodyMode,omitempty"`
+	// EncryptedSize is the size of the encrypted contents before they were
+	// divided up between the horcruxes of the set.
+	EncryptedSize int64 `json:"encryptedSize,omitempty"`
+	BodySize      int64 `json:"bodySize,omitempty"`
+	// BodyDigest is the HMAC-SHA256 of this horcrux's body under the MAC key
+	BodyDigest []byte `json:"bodyDigest,omitempty"`
+	// SealedContentDigest is the SHA-256 digest of the original file's
+	// contents, sealed with the metadata key so that it's only readable once
+	// the horcruxes have been bound.
+	SealedContentDigest []byte `json:"sealedContentDigest,omitempty"`
+	// SealedFileInfo holds the original file's permissions, modification time
+	// and owner (see originalFileInfo), sealed with the file info key. It's
+	// missing for horcruxes split from stdin, which has none of those.
+	SealedFileInfo []byte `json:"sealedFileInfo,omitempty"`
+	// Archive is the format the original was archived in if it was a
+	// directory (see ArchiveTar), and empty if it was a file.
+	Archive string `json:"archive,omitempty"`
+}
+
+// setKey identifies the set the horcrux belongs to. v1 horcruxes don't record
+// a set ID so they have to make do with their original filename and timestamp,
+// even though two splits of the same file in the same second share those.
+func (h HorcruxHeader) setKey() string {
+	if h.SetID != "" {
+		return h.SetID
+	}
+	return fmt.Sprintf("%s@%d", h.OriginalFilename, h.Timestamp)
+}
+
+// validateOriginalFilename makes sure that a filename from a horcrux's header
+// (which anybody could have written) can only ever name a file in the
+// directory we bind into, and can't mess with the user's terminal when we print
+// it.
+func validateOriginalFilename(name string) error {
+	switch {
+	case name == "":
+		return errors.New("it is empty")
+	case name == "." || name == "..":
+		return errors.New("it refers to a directory")
+	case strings.ContainsAny(name, `/\`):
+		return errors.New("it contains a path separator")
+	case filepath.IsAbs(name) || filepath.VolumeName(name) != "":
+		return errors.New("it is an absolute path")
+	case len(name) >= 2 && name[1] == ':' && unicode.IsLetter(rune(name[0])):
+		// Windows would take it to be on another drive, and horcruxes made
+		// on one platform may well be bound on another
+		return errors.New("it starts with a drive letter")
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return errors.New("it contains control characters or invalid UTF-8")
+		}
+	}
+
+	return nil
+}
+
+// display returns a string from a header (like the original filename) in a
+// form that's safe to print. We print what we find in a header before we know
+// whether we'll trust it, so anything that isn't printable is quoted and
+// escaped rather than let loose on the user's terminal.
+func display(s string) string {
+	for _, r := range s {
+		if !unicode.IsPrint(r) || r == utf8.RuneError {
+			return strconv.Quote(s)
+		}
+	}
+	return s
 }
 
 type Horcrux struct {
-	path   string
-	header HorcruxHeader
-	file   *os.File
+	path       string
+	header     HorcruxHeader
+	file       *os.File
+	bodyOffset int64
 }
 
-// returns a horcrux with its header parsed, and it's file's read pointer
-// right after the header.
+// ErrInvalidHeader is wrapped by the error we return when a file can be read
+// but doesn't start with a horcrux header we can make sense of
+var ErrInvalidHeader = errors.New("invalid horcrux header")
+
+// returns a horcrux with its header parsed. So that we can look through any
+// number of horcruxes without running out of file handles, its file isn't
+// kept open: call open before reading its body, and close once you're done.
 func NewHorcrux(path string) (*Horcrux, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
 	header, err := GetHeaderFromHorcruxFile(file)
 	if err != nil {
 		return nil, err
 	}
 
+	bodyOffset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Horcrux{
-		path:   path,
-		file:   file,
-		header: *header,
+		path:       path,
+		header:     *header,
+		bodyOffset: bodyOffset,
 	}, nil
 }
 
@@ -47,19 +154,25 @@ func NewHorcrux(path string) (*Horcrux, error) {
 // the file with its read pointer at the start of the encrypted content
 // so that we can later directly read from that point
 // yes this is a side effect, no I'm not proud of it.
+// If the file can be read but has no valid header, the error wraps
+// ErrInvalidHeader.
 func GetHeaderFromHorcruxFile(file *os.File) (*HorcruxHeader, error) {
 	currentHeader := &HorcruxHeader{}
 	scanner := bufio.NewScanner(file)
+	// key fragment commitments make for a long header line
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	bytesBeforeBody := 0
+	found := false
 	for scanner.Scan() {
 		line := scanner.Text()
 		bytesBeforeBody += len(scanner.Bytes()) + 1
 		if line == "-- HEADER --" {
+			found = true
 			scanner.Scan()
 			bytesBeforeBody += len(scanner.Bytes()) + 1
 			headerLine := scanner.Bytes()
 			if err := json.Unmarshal(headerLine, currentHeader); err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %s", ErrInvalidHeader, err)
 			}
 
 			scanner.Scan() // one more to get past the body line
@@ -67,16 +180,76 @@ func GetHeaderFromHorcruxFile(file *os.File) (*HorcruxHeader, error) {
 			break
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHeader, err)
+		}
+		return nil, err
+	}
 	if _, err := file.Seek(int64(bytesBeforeBody), io.SeekStart); err != nil {
 		return nil, err
 	}
 
-	if currentHeader == nil {
-		return nil, errors.New("could not find header in horcrux file")
+	if !found {
+		return nil, fmt.Errorf("%w: could not find header in horcrux file", ErrInvalidHeader)
+	}
+
+	// horcruxes from before we versioned the format don't have a version
+	if currentHeader.Version == 0 {
+		currentHeader.Version = legacyVersion
 	}
+
 	return currentHeader, nil
 }
 
+// open opens the horcrux's file for reading its body, with the read pointer
+// at the start of the body. The header is read again, in case the file has
+// been swapped for another one since we first read it.
+func (h *Horcrux) open() error {
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+
+	header, err := GetHeaderFromHorcruxFile(file)
+	if err == nil && !reflect.DeepEqual(*header, h.header) {
+		err = fmt.Errorf("%s has changed since we first read it", h.path)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	h.file = file
+	return nil
+}
+
+// close closes the file that open opened, if it's open
+func (h *Horcrux) close() {
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+}
+
+// openHorcruxes opens every one of the horcruxes, or none of them if any can't
+// be opened. Close them again with closeHorcruxes.
+func openHorcruxes(horcruxes []Horcrux) error {
+	for i := range horcruxes {
+		if err := horcruxes[i].open(); err != nil {
+			closeHorcruxes(horcruxes[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func closeHorcruxes(horcruxes []Horcrux) {
+	for i := range horcruxes {
+		horcruxes[i].close()
+	}
+}
+
 func (h *Horcrux) GetHeader() HorcruxHeader {
 	return h.header
 }
@@ -85,6 +258,20 @@ func (h *Horcrux) GetPath() string {
 	return h.path
 }
 
+// GetFile returns the horcrux's file, which is nil unless it's been opened
 func (h *Horcrux) GetFile() *os.File {
 	return h.file
 }
+
+// rewind moves the file's read pointer back to the start of the body, so that
+// it can be read again
+func (h *Horcrux) rewind() error {
+	_, err := h.file.Seek(h.bodyOffset, io.SeekStart)
+	return err
+}
+
+// GetBody returns the horcrux's body for reading at arbitrary offsets, without
+// moving the file's read pointer
+func (h *Horcrux) GetBody() *io.SectionReader {
+	return io.NewSectionReader(h.file, h.bodyOffset, math.MaxInt64-h.bodyOffset)
+}
@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateOriginalFilename(t *testing.T) {
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "diary.txt", valid: true},
+		{name: ".bashrc", valid: true},
+		{name: "日記.txt", valid: true},
+		{name: "notes 10:30.txt", valid: true},
+		{name: "", valid: false},
+		{name: ".", valid: false},
+		{name: "..", valid: false},
+		{name: "../x", valid: false},
+		{name: "a/b", valid: false},
+		{name: `a\b`, valid: false},
+		{name: "/abs", valid: false},
+		{name: "C:x", valid: false},
+		{name: `C:\x`, valid: false},
+		{name: "diary\n.txt", valid: false},
+		{name: "\x1b[2Jdiary.txt", valid: false},
+		{name: "diary\x7f.txt", valid: false},
+		{name: "diary\xff.txt", valid: false},
+	}
+
+	for _, c := range cases {
+		err := validateOriginalFilename(c.name)
+		if c.valid && err != nil {
+			t.Errorf("%q: expected it to be valid, got %s", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%q: expected it to be rejected", c.name)
+		}
+	}
+}
+
+func TestValidateHorcruxesRejectsUnsafeOriginalFilename(t *testing.T) {
+	for _, name := range []string{"../x", "a/b", `a\b`, "/abs", "C:x", ".", "..", "diary\n.txt", "diary\xff.txt"} {
+		horcruxes := make([]Horcrux, 2)
+		for i := range horcruxes {
+			horcruxes[i] = Horcrux{
+				path: horcruxFilename("diary.txt", i+1, 3),
+				header: HorcruxHeader{
+					Version:          legacyVersion,
+					OriginalFilename: name,
+					Index:            i + 1,
+					Total:            3,
+					Threshold:        2,
+				},
+			}
+		}
+
+		err := ValidateHorcruxes(horcruxes)
+		var corruptErr *CorruptHorcruxError
+		if !errors.As(err, &corruptErr) {
+			t.Errorf("%q: expected a CorruptHorcruxError, got %v", name, err)
+		}
+	}
+}
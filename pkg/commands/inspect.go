@@ -0,0 +1,152 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrInspectionFailed is returned when any of the files given to Inspect
+// couldn't be read as a horcrux
+var ErrInspectionFailed = errors.New("inspection failed")
+
+// inspection is what we report about a single horcrux. The key fragment is
+// left out unless it's explicitly asked for: anybody who collects enough of
+// them can resurrect the original file.
+type inspection struct {
+	Path             string `json:"path"`
+	Error            string `json:"error,omitempty"`
+	SetID            string `json:"setId,omitempty"`
+	OriginalFilename string `json:"originalFilename,omitempty"`
+	Timestamp        int64  `json:"timestamp,omitempty"`
+	Index            int    `json:"index,omitempty"`
+	Total            int    `json:"total,omitempty"`
+	Threshold        int    `json:"threshold,omitempty"`
+	Version          int    `json:"version,omitempty"`
+	BodyMode         string `json:"bodyMode,omitempty"`
+	Archive          string `json:"archive,omitempty"`
+	BodySize         int64  `json:"bodySize"`
+	KeyFragment      []byte `json:"keyFragment,omitempty"`
+}
+
+// Inspect prints what each of the horcruxes at the given paths says about
+// itself in its header, without binding anything. If asJSON is true it prints
+// a JSON array with an object for each horcrux instead, for scripts.
+func Inspect(paths []string, asJSON bool, showKeyFragment bool) error {
+	inspections := make([]inspection, len(paths))
+	failed := false
+	for i, path := range paths {
+		inspections[i] = inspect(path, showKeyFragment)
+		if inspections[i].Error != "" {
+			failed = true
+		}
+	}
+
+	if asJSON {
+		output, err := json.MarshalIndent(inspections, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+	} else {
+		for i, inspection := range inspections {
+			if i > 0 {
+				fmt.Println()
+			}
+			printInspection(inspection)
+		}
+	}
+
+	if failed {
+		return ErrInspectionFailed
+	}
+	return nil
+}
+
+func inspect(path string, showKeyFragment bool) inspection {
+	result := inspection{Path: path}
+
+	file, err := os.Open(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer file.Close()
+
+	header, err := GetHeaderFromHorcruxFile(file)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// rather than trusting the size in the header (which old horcruxes don't
+	// have anyway) we report how big the body actually is
+	bodyOffset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	info, err := file.Stat()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.SetID = header.SetID
+	result.OriginalFilename = header.OriginalFilename
+	result.Timestamp = header.Timestamp
+	result.Index = header.Index
+	result.Total = header.Total
+	result.Threshold = header.Threshold
+	result.Version = header.Version
+	result.BodyMode = header.bodyMode()
+	result.Archive = header.Archive
+	result.BodySize = info.Size() - bodyOffset
+	if showKeyFragment {
+		result.KeyFragment = header.KeyFragment
+	}
+
+	return result
+}
+
+func printInspection(i inspection) {
+	fmt.Println(i.Path)
+	if i.Error != "" {
+		fmt.Printf("  could not read horcrux: %s\n", i.Error)
+		return
+	}
+
+	setID := display(i.SetID)
+	if setID == "" {
+		setID = "none (made before horcruxes recorded their set)"
+	}
+
+	bodyMode := i.BodyMode
+	switch i.BodyMode {
+	case BodyModeStriped:
+		bodyMode += " (every horcrux of the set is required)"
+	case BodyModeFullCopy:
+		bodyMode += " (this horcrux holds the whole encrypted file)"
+	case BodyModeErasure:
+		bodyMode += fmt.Sprintf(" (any %d horcruxes of the set can recover the encrypted file)", i.Threshold)
+	}
+
+	fmt.Printf("  set ID:            %s\n", setID)
+	if i.Archive != "" {
+		fmt.Printf("  original filename: %s (a directory, archived with %s)\n", display(i.OriginalFilename), display(i.Archive))
+	} else {
+		fmt.Printf("  original filename: %s\n", display(i.OriginalFilename))
+	}
+	fmt.Printf("  split at:          %s\n", time.Unix(i.Timestamp, 0).Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("  horcrux:           %d of %d\n", i.Index, i.Total)
+	fmt.Printf("  threshold:         %d\n", i.Threshold)
+	fmt.Printf("  format version:    %d\n", i.Version)
+	fmt.Printf("  body mode:         %s\n", display(bodyMode))
+	fmt.Printf("  body size:         %d bytes\n", i.BodySize)
+	if i.KeyFragment != nil {
+		fmt.Printf("  key fragment:      %x\n", i.KeyFragment)
+	}
+}
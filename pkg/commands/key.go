@@ -0,0 +1,331 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/jesseduffield/horcrux/pkg/encryption"
+	"github.com/jesseduffield/horcrux/pkg/shamir"
+)
+
+// if there are more combinations of key fragments than this to try, we give up
+const maxKeyFragmentCombinations = 10000
+
+// combineKey combines the key fragments of the given horcruxes into the key.
+// Any key fragment that turns out to be bad is left out, and an error is
+// returned for each so that the caller can point the finger at the horcruxes
+// responsible.
+//
+// Verifiable key fragments can be checked one at a time. For the rest, if we
+// have more than the threshold number of fragments we exploit the redundancy:
+// if the key they combine into can be checked and is wrong, we try
+// threshold-sized subsets of them until one produces a key that checks out,
+// and if it can't be checked (as with v1 horcruxes, which aren't authenticated
+// at all) we go with the key that most subsets agree on.
+func combineKey(horcruxes []Horcrux) ([]byte, []error, error) {
+	header := horcruxes[0].GetHeader()
+
+	goodHorcruxes, badKeyFragments := verifyKeyFragments(horcruxes)
+	if len(goodHorcruxes) < header.Threshold {
+		return nil, badKeyFragments, fmt.Errorf("%w: only %d of them are valid but %d are required to resurrect the original file", ErrBadKeyFragments, len(goodHorcruxes), header.Threshold)
+	}
+
+	key, err := combineKeyFragments(goodHorcruxes)
+	if err != nil {
+		return nil, badKeyFragments, err
+	}
+
+	correct, checkable := checkKey(goodHorcruxes, key)
+	if correct || len(goodHorcruxes) == header.Threshold {
+		// with no fragments to spare there's nothing to compare the key with:
+		// if it's wrong and can be checked, decryption will fail and say so.
+		return key, badKeyFragments, nil
+	}
+
+	var subset []Horcrux
+	if checkable {
+		subset, key = findGoodKeyFragments(goodHorcruxes, header.Threshold)
+		if subset == nil {
+			return nil, badKeyFragments, fmt.Errorf("%w: they disagree with each other and no combination of %d of them produces the right key", ErrBadKeyFragments, header.Threshold)
+		}
+	} else {
+		subset, key = findMajorityKey(goodHorcruxes, header.Threshold)
+		if subset == nil {
+			return nil, badKeyFragments, fmt.Errorf("%w: they disagree with each other and there's no telling which of them are right", ErrBadKeyFragments)
+		}
+	}
+
+	// now that we know the right key, any fragment that doesn't produce it
+	// when swapped in for a member of the good subset is a bad one
+	inSubset := map[string]bool{}
+	for _, horcrux := range subset {
+		inSubset[horcrux.GetPath()] = true
+	}
+	for _, horcrux := range goodHorcruxes {
+		if inSubset[horcrux.GetPath()] {
+			continue
+		}
+
+		candidate := append(append([]Horcrux{}, subset[:header.Threshold-1]...), horcrux)
+		candidateKey, err := combineKeyFragments(candidate)
+		if err != nil || !bytes.Equal(candidateKey, key) {
+			badKeyFragments = append(badKeyFragments, &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: "its key fragment disagrees with those of the other horcruxes"})
+		}
+	}
+
+	return key, badKeyFragments, nil
+}
+
+// combineKeyWithReport combines the key, letting the user know about any key
+// fragments that had to be left out
+func combineKeyWithReport(horcruxes []Horcrux) ([]byte, error) {
+	key, badKeyFragments, err := combineKey(horcruxes)
+	for _, badKeyFragment := range badKeyFragments {
+		fmt.Fprintf(Messages, "%s, so we've left it out\n", badKeyFragment)
+	}
+	return key, err
+}
+
+func combineKeyFragments(horcruxes []Horcrux) ([]byte, error) {
+	keyFragments := make([][]byte, len(horcruxes))
+	for i := range keyFragments {
+		keyFragments[i] = horcruxes[i].GetHeader().KeyFragment
+	}
+
+	if horcruxes[0].GetHeader().KeyScheme == KeySchemeFeldman {
+		return shamir.CombineVerifiable(keyFragments)
+	}
+	return shamir.Combine(keyFragments)
+}
+
+// checkKey tells us whether the key is correct, if there's a way of telling
+// short of decrypting the whole body.
+func checkKey(horcruxes []Horcrux, key []byte) (correct bool, checkable bool) {
+	header := horcruxes[0].GetHeader()
+
+	keys, err := deriveKeys(key, header)
+	if err != nil {
+		return false, false
+	}
+
+	if header.SealedContentDigest != nil {
+		_, err := encryption.OpenMetadata(keys.metadata, header.NoncePrefix, header.SealedContentDigest)
+		return err == nil, true
+	}
+
+	return false, false
+}
+
+// findGoodKeyFragments tries each subset of `threshold` horcruxes until it
+// finds one whose key fragments combine into a key that checks out
+func findGoodKeyFragments(horcruxes []Horcrux, threshold int) ([]Horcrux, []byte) {
+	var goodSubset []Horcrux
+	var goodKey []byte
+	forEachSubset(horcruxes, threshold, func(subset []Horcrux) bool {
+		key, err := combineKeyFragments(subset)
+		if err != nil {
+			return true
+		}
+		if correct, _ := checkKey(subset, key); correct {
+			goodSubset, goodKey = subset, key
+			return false
+		}
+		return true
+	})
+
+	return goodSubset, goodKey
+}
+
+// findMajorityKey combines the key fragments of each subset of `threshold`
+// horcruxes and returns the key that more of them combine into than any other,
+// along with a subset that produces it. If no key comes out on top (say, with
+// one fragment to spare and one of them bad, where every subset disagrees with
+// every other) there's no telling which key is right and it returns nil.
+func findMajorityKey(horcruxes []Horcrux, threshold int) ([]Horcrux, []byte) {
+	votes := map[string]int{}
+	subsets := map[string][]Horcrux{}
+	forEachSubset(horcruxes, threshold, func(subset []Horcrux) bool {
+		key, err := combineKeyFragments(subset)
+		if err != nil {
+			return true
+		}
+		votes[string(key)]++
+		if subsets[string(key)] == nil {
+			subsets[string(key)] = subset
+		}
+		return true
+	})
+
+	majority := ""
+	tied := false
+	for key, count := range votes {
+		switch {
+		case count > votes[majority]:
+			majority = key
+			tied = false
+		case count == votes[majority]:
+			tied = true
+		}
+	}
+	if majority == "" || tied {
+		return nil, nil
+	}
+
+	return subsets[majority], []byte(majority)
+}
+
+// checkKeyFragmentsAgree makes sure that every subset of `threshold` of the
+// horcruxes combines into the same key. When the key can't be checked, that's
+// the only sign we have that none of the key fragments is bad.
+func checkKeyFragmentsAgree(horcruxes []Horcrux) error {
+	var firstKey []byte
+	agree := true
+	forEachSubset(horcruxes, horcruxes[0].GetHeader().Threshold, func(subset []Horcrux) bool {
+		key, err := combineKeyFragments(subset)
+		if err != nil || (firstKey != nil && !bytes.Equal(key, firstKey)) {
+			agree = false
+			return false
+		}
+		firstKey = key
+		return true
+	})
+
+	if !agree {
+		return fmt.Errorf("%w: they disagree with each other, so at least one of them is corrupt", ErrBadKeyFragments)
+	}
+	return nil
+}
+
+// forEachSubset calls fn with each subset of `size` horcruxes, in
+// lexicographic order, until fn returns false or we've tried
+// maxKeyFragmentCombinations of them
+func forEachSubset(horcruxes []Horcrux, size int, fn func(subset []Horcrux) bool) {
+	indices := make([]int, size)
+	for i := range indices {
+		indices[i] = i
+	}
+
+	for attempt := 0; attempt < maxKeyFragmentCombinations; attempt++ {
+		subset := make([]Horcrux, size)
+		for i, index := range indices {
+			subset[i] = horcruxes[index]
+		}
+		if !fn(subset) {
+			return
+		}
+
+		// move on to the next combination of indices, in lexicographic order
+		i := size - 1
+		for i >= 0 && indices[i] == len(horcruxes)-size+i {
+			i--
+		}
+		if i < 0 {
+			return
+		}
+		indices[i]++
+		for j := i + 1; j < size; j++ {
+			indices[j] = indices[j-1] + 1
+		}
+	}
+}
+
+// verifyKeyFragments checks each horcrux's key fragment against the
+// commitments that most of the horcruxes agree on, returning the horcruxes
+// whose fragments are valid and an error for each of the rest. Horcruxes
+// whose key fragments can't be verified are all considered valid.
+func verifyKeyFragments(horcruxes []Horcrux) ([]Horcrux, []error) {
+	if horcruxes[0].GetHeader().KeyScheme != KeySchemeFeldman {
+		return horcruxes, nil
+	}
+
+	// every horcrux carries the same commitments unless one has been tampered
+	// with, so we go with the majority.
+	votes := map[string]int{}
+	majority := ""
+	for _, horcrux := range horcruxes {
+		commitments := string(bytes.Join(horcrux.GetHeader().Commitments, nil))
+		votes[commitments]++
+		if votes[commitments] > votes[majority] {
+			majority = commitments
+		}
+	}
+
+	goodHorcruxes := []Horcrux{}
+	errs := []error{}
+	for _, horcrux := range horcruxes {
+		header := horcrux.GetHeader()
+		if string(bytes.Join(header.Commitments, nil)) != majority {
+			errs = append(errs, &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: "its key fragment commitments disagree with those of the other horcruxes"})
+			continue
+		}
+		if err := shamir.VerifyShare(header.KeyFragment, header.Commitments); err != nil {
+			errs = append(errs, &CorruptHorcruxError{Path: horcrux.GetPath(), Problem: fmt.Sprintf("its key fragment is invalid: %s", err)})
+			continue
+		}
+		goodHorcruxes = append(goodHorcruxes, horcrux)
+	}
+
+	return goodHorcruxes, errs
+}
+
+// labels for the keys derived from the master key, one per purpose. Never
+// reuse a label for a different purpose.
+const (
+	bodyKeyLabel     = "horcrux body encryption"
+	metadataKeyLabel = "horcrux metadata encryption"
+	macKeyLabel      = "horcrux body authentication"
+	fileInfoKeyLabel = "horcrux file info encryption"
+)
+
+// keys holds the key for each purpose. v1 horcruxes use the master key for
+// encryption and have no metadata, MAC or file info key.
+type keys struct {
+	body     []byte
+	metadata []byte
+	mac      []byte
+	fileInfo []byte
+}
+
+// deriveKeys derives the key for each purpose from the master key that's
+// split between the horcruxes of the set the header belongs to.
+func deriveKeys(masterKey []byte, header HorcruxHeader) (keys, error) {
+	format, err := getFormat(header.Version)
+	if err != nil {
+		return keys{}, err
+	}
+
+	if header.KeyDerivation != format.keyDerivation {
+		return keys{}, fmt.Errorf("unexpected key derivation %q for horcrux format version %d", header.KeyDerivation, header.Version)
+	}
+
+	switch format.keyDerivation {
+	case "":
+		return keys{body: masterKey}, nil
+	case KeyDerivationHKDF:
+		if len(header.KeyDerivationSalt) == 0 {
+			return keys{}, errors.New("horcrux header is missing its key derivation salt")
+		}
+		salt := header.KeyDerivationSalt
+		body, err := encryption.DeriveKey(masterKey, salt, bodyKeyLabel, len(masterKey))
+		if err != nil {
+			return keys{}, err
+		}
+		metadata, err := encryption.DeriveKey(masterKey, salt, metadataKeyLabel, len(masterKey))
+		if err != nil {
+			return keys{}, err
+		}
+		mac, err := encryption.DeriveKey(masterKey, salt, macKeyLabel, sha256.Size)
+		if err != nil {
+			return keys{}, err
+		}
+		fileInfo, err := encryption.DeriveKey(masterKey, salt, fileInfoKeyLabel, len(masterKey))
+		if err != nil {
+			return keys{}, err
+		}
+		return keys{body: body, metadata: metadata, mac: mac, fileInfo: fileInfo}, nil
+	default:
+		return keys{}, fmt.Errorf("unknown key derivation %q", format.keyDerivation)
+	}
+}
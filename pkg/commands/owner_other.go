@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package commands
+
+import "os"
+
+// fileOwner returns nothing, as files don't have numeric owners here
+func fileOwner(info os.FileInfo) (uid *int, gid *int) {
+	return nil, nil
+}
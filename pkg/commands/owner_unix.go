@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package commands
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user and group IDs of the file's owner
+func fileOwner(info os.FileInfo) (uid *int, gid *int) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, nil
+	}
+	u, g := int(stat.Uid), int(stat.Gid)
+	return &u, &g
+}
@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A directory may hold horcruxes from any number of splits, so before binding
+// we group them by the set they belong to.
+
+// GetHorcruxSets reads the horcruxes at the given paths and groups them by set,
+// in the order each set was first found. Each set is sorted by index.
+func GetHorcruxSets(paths []string) ([][]Horcrux, error) {
+	horcruxes, err := GetHorcruxes(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := [][]Horcrux{}
+	setIndices := map[string]int{}
+	for _, horcrux := range horcruxes {
+		key := horcrux.GetHeader().setKey()
+		i, ok := setIndices[key]
+		if !ok {
+			i = len(sets)
+			setIndices[key] = i
+			sets = append(sets, []Horcrux{})
+		}
+		sets[i] = append(sets[i], horcrux)
+	}
+
+	for _, set := range sets {
+		sort.Sort(byIndex(set))
+	}
+
+	return sets, nil
+}
+
+// SelectHorcruxSet returns the set whose set ID starts with the given selection
+// or whose original filename is the selection.
+func SelectHorcruxSet(sets [][]Horcrux, selection string) ([]Horcrux, error) {
+	matches := [][]Horcrux{}
+	for _, set := range sets {
+		header := set[0].GetHeader()
+		if header.OriginalFilename == selection || (header.SetID != "" && strings.HasPrefix(header.SetID, selection)) {
+			matches = append(matches, set)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no set of horcruxes has the set ID or original filename %q", selection)
+	case 1:
+		return matches[0], nil
+	default:
+		descriptions := make([]string, len(matches))
+		for i, set := range matches {
+			descriptions[i] = describeSet(set)
+		}
+		return nil, fmt.Errorf("%d sets of horcruxes match %q, please choose one by its set ID:\n%s", len(matches), selection, strings.Join(descriptions, "\n"))
+	}
+}
+
+// describeSet names a set for the user. The name of a directory ends with a
+// slash so that it's clear it's not a file.
+func describeSet(set []Horcrux) string {
+	header := set[0].GetHeader()
+	name := display(header.OriginalFilename)
+	if header.Archive != "" {
+		name += "/"
+	}
+	if header.SetID == "" {
+		return fmt.Sprintf("%s (split at %s)", name, time.Unix(header.Timestamp, 0).Format("2006-01-02 15:04:05"))
+	}
+	return fmt.Sprintf("%s (set %s)", name, display(shortSetID(header.SetID)))
+}
+
+// shortSetID abbreviates a set ID for display. Sets can be selected by any
+// prefix of their ID, so the abbreviation still identifies the set in
+// practice.
+func shortSetID(setID string) string {
+	if len(setID) > 8 {
+		return setID[:8]
+	}
+	return setID
+}
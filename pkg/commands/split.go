@@ -1,49 +1,121 @@
 package commands
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jesseduffield/horcrux/pkg/encryption"
+	"github.com/jesseduffield/horcrux/pkg/erasure"
 	"github.com/jesseduffield/horcrux/pkg/multiplexing"
 	"github.com/jesseduffield/horcrux/pkg/shamir"
 )
 
-func SplitWithPrompt(path string) error {
-	total, threshold, err := obtainTotalAndThreshold()
-	if err != nil {
-		return err
-	}
+// DefaultFileMode is the permissions horcruxes and resurrected files are
+// created with unless we're told otherwise (or, for a resurrected file, know
+// what the original file's were). Either could be somebody's secret, so only
+// their owner gets to read them.
+const DefaultFileMode os.FileMode = 0600
 
-	return Split(path, filepath.Dir(path), total, threshold)
+// SplitOptions controls how Split divides a file into horcruxes
+type SplitOptions struct {
+	// Total is how many horcruxes to make
+	Total int
+	// Threshold is how many of the horcruxes will be required to bind them
+	Threshold int
+	// FullCopy makes every horcrux hold a full copy of the encrypted file. When
+	// fewer than all the horcruxes are required it's otherwise erasure coded
+	// between them.
+	FullCopy bool
+	// Overwrite lets us replace existing files where the horcruxes would go.
+	// Otherwise we return an error wrapping ErrDestinationExists.
+	Overwrite bool
+	// Mode is the permissions the horcruxes are created with. If it's zero we
+	// use DefaultFileMode.
+	Mode os.FileMode
 }
 
-func Split(path string, destination string, total int, threshold int) error {
-	key, err := generateKey()
+// Split splits the file at path into horcruxes in the destination directory.
+// If path is a directory, everything in it is split as a tar archive, and bind
+// recreates the directory.
+func Split(path string, destination string, options SplitOptions) error {
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
+	if info.IsDir() {
+		return splitDirectory(path, info, destination, options)
+	}
 
-	keyFragments, err := shamir.Split(key, total, threshold)
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	timestamp := time.Now().Unix()
+	return splitReader(file, filepath.Base(path), newOriginalFileInfo(info), "", destination, options)
+}
 
-	file, err := os.Open(path)
+func splitDirectory(path string, info os.FileInfo, destination string, options SplitOptions) error {
+	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-	originalFilename := filepath.Base(path)
+	// if path is a symlink to a directory, we split the directory it points
+	// to (under the symlink's name), because walking the symlink itself would
+	// get us nowhere
+	root, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return err
+	}
+	absDestination, err := filepath.Abs(destination)
+	if err != nil {
+		return err
+	}
+	// otherwise we'd end up archiving the horcruxes as we write them
+	for _, dir := range []string{absPath, root} {
+		if rel, err := filepath.Rel(dir, absDestination); err == nil && !escapesTree(filepath.ToSlash(rel)) {
+			return fmt.Errorf("the horcruxes of %s can't go inside it: please choose another directory with -output-dir", path)
+		}
+	}
+
+	reader := newDirectoryReader(root)
+	defer reader.Close()
+
+	return splitReader(reader, filepath.Base(absPath), newOriginalFileInfo(info), ArchiveTar, destination, options)
+}
+
+// SplitReader is like Split, but splits whatever is read from r, naming the
+// original file originalFilename. r is read once from start to finish without
+// holding on to more than a little of it at a time, so it can be stdin. As
+// there's no file, there are no permissions or the like for bind to restore.
+func SplitReader(r io.Reader, originalFilename string, destination string, options SplitOptions) error {
+	return splitReader(r, originalFilename, nil, "", destination, options)
+}
+
+// splitReader is SplitReader with the original file's details, if we know
+// them, and the format of the archive it's in if it's a directory
+func splitReader(r io.Reader, originalFilename string, fileInfo *originalFileInfo, archive string, destination string, options SplitOptions) error {
+	total, threshold := options.Total, options.Threshold
+	mode := options.Mode
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+
+	if err := validateOriginalFilename(originalFilename); err != nil {
+		return fmt.Errorf("%q can't be used as the original filename: %s", originalFilename, err)
+	}
 
 	// create destination directory if it does not already exist.
 	stat, err := os.Stat(destination)
@@ -60,80 +132,287 @@ func Split(path string, destination string, total int, threshold int) error {
 		}
 	}
 
+	// we check before reading anything, so that stdin isn't used up for
+	// nothing. Overwriting the horcruxes of an earlier split could leave it
+	// with too few of them to be bound, so we don't do it unless asked to.
+	if !options.Overwrite {
+		if err := checkNoExistingHorcruxes(destination, originalFilename, total); err != nil {
+			return err
+		}
+	}
+
+	// the horcruxes are written to temp files and only moved into place once
+	// every one of them is complete, so that if we fail partway through we
+	// don't leave behind a set of horcruxes that can't be bound, or destroy
+	// existing files with the same names.
+	horcruxFiles := []*atomicFile{}
+	createHorcruxFile := func(index int) (*os.File, error) {
+		horcruxPath := filepath.Join(destination, horcruxFilename(originalFilename, index, total))
+		fmt.Printf("creating %s\n", horcruxPath)
+
+		horcruxFile, err := createAtomicFile(horcruxPath, mode)
+		if err != nil {
+			return nil, err
+		}
+		horcruxFiles = append(horcruxFiles, horcruxFile)
+		return horcruxFile.File, nil
+	}
+
+	if err := split(r, originalFilename, fileInfo, archive, total, threshold, defaultBodyMode(total, threshold, options.FullCopy), createHorcruxFile); err != nil {
+		for _, horcruxFile := range horcruxFiles {
+			horcruxFile.Abort()
+		}
+		return err
+	}
+
+	// a partial set is no use to anyone, and nor is one that's half this set
+	// and half the one it replaced
+	if err := commitAll(horcruxFiles); err != nil {
+		return err
+	}
+
+	fmt.Println("Done!")
+
+	return nil
+}
+
+// checkNoExistingHorcruxes returns an error wrapping ErrDestinationExists if
+// any of the horcruxes of a split of originalFilename into `total` horcruxes
+// would overwrite an existing file
+func checkNoExistingHorcruxes(destination string, originalFilename string, total int) error {
+	existing := []string{}
+	for index := 1; index <= total; index++ {
+		horcruxPath := filepath.Join(destination, horcruxFilename(originalFilename, index, total))
+		if _, err := os.Lstat(horcruxPath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		existing = append(existing, "  "+describeExistingFile(horcruxPath))
+	}
+
+	if len(existing) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("not overwriting existing files: %w (pass -force to overwrite them, or -output-dir to put the horcruxes somewhere else):\n%s", ErrDestinationExists, strings.Join(existing, "\n"))
+}
+
+// describeExistingFile says what's at path, so that the user can tell whether
+// it's something they'd miss
+func describeExistingFile(path string) string {
+	horcrux, err := NewHorcrux(path)
+	if err != nil {
+		return path
+	}
+	return fmt.Sprintf("%s (a horcrux of %s)", path, describeSet([]Horcrux{*horcrux}))
+}
+
+// split encrypts the contents of r and writes it out to `total` horcruxes,
+// obtaining the file for each horcrux (in order of index) from createHorcruxFile.
+// The files are left open for the caller to sync and close. fileInfo may be nil,
+// and archive is empty unless the original is a directory.
+func split(r io.Reader, originalFilename string, fileInfo *originalFileInfo, archive string, total int, threshold int, bodyMode string, createHorcruxFile func(index int) (*os.File, error)) error {
+	key, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	keyFragments, commitments, err := shamir.SplitVerifiable(key, total, threshold)
+	if err != nil {
+		return err
+	}
+
+	// check that every fragment we hand out is verifiable before it's too late
+	for i, keyFragment := range keyFragments {
+		if err := shamir.VerifyShare(keyFragment, commitments); err != nil {
+			return fmt.Errorf("key fragment %d failed verification: %s", i+1, err)
+		}
+	}
+
+	noncePrefix, err := encryption.GenerateNoncePrefix()
+	if err != nil {
+		return err
+	}
+
+	format, err := getFormat(CurrentVersion)
+	if err != nil {
+		return err
+	}
+
+	keyDerivationSalt, err := encryption.GenerateSalt()
+	if err != nil {
+		return err
+	}
+
+	setID, err := generateSetID()
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+
+	headers := make([]HorcruxHeader, total)
+	for i := range headers {
+		headers[i] = HorcruxHeader{
+			Version:           CurrentVersion,
+			SetID:             setID,
+			OriginalFilename:  originalFilename,
+			Timestamp:         timestamp,
+			Index:             i + 1,
+			Total:             total,
+			KeyFragment:       keyFragments[i],
+			KeyScheme:         format.keyScheme,
+			Commitments:       commitments,
+			KeyDerivation:     format.keyDerivation,
+			KeyDerivationSalt: keyDerivationSalt,
+			Threshold:         threshold,
+			BodyCipher:        format.bodyCipher,
+			NoncePrefix:       noncePrefix,
+			BodyMode:          bodyMode,
+			Archive:           archive,
+		}
+	}
+
+	keys, err := deriveKeys(key, headers[0])
+	if err != nil {
+		return err
+	}
+
+	sealedFileInfo, err := sealFileInfo(fileInfo, keys, noncePrefix)
+	if err != nil {
+		return err
+	}
+
 	horcruxFiles := make([]*os.File, total)
+	headerOffsets := make([]int64, total)
+	headerLengths := make([]int, total)
 	for i := range horcruxFiles {
 		index := i + 1
+		headers[i].SealedFileInfo = sealedFileInfo
 
-		headerBytes, err := json.Marshal(&HorcruxHeader{
-			OriginalFilename: originalFilename,
-			Timestamp:        timestamp,
-			Index:            index,
-			Total:            total,
-			KeyFragment:      keyFragments[i],
-			Threshold:        threshold,
-		})
+		// we don't know the size and digest of the body until we've written it,
+		// so for now we write a placeholder which is at least as long as the
+		// final header and come back to fill it in later.
+		placeholder := headers[i]
+		placeholder.EncryptedSize = math.MaxInt64
+		placeholder.BodySize = math.MaxInt64
+		placeholder.BodyDigest = make([]byte, sha256.Size)
+		placeholder.SealedContentDigest = make([]byte, sha256.Size+encryption.Overhead)
+		headerBytes, err := json.Marshal(&placeholder)
 		if err != nil {
 			return err
 		}
 
-		originalFilenameWithoutExt := strings.TrimSuffix(originalFilename, filepath.Ext(originalFilename))
-		horcruxFilename := fmt.Sprintf("%s_%d_of_%d.horcrux", originalFilenameWithoutExt, index, total)
-		horcruxPath := filepath.Join(destination, horcruxFilename)
-		fmt.Printf("creating %s\n", horcruxPath)
-
-		// clearing file in case it already existed
-		_ = os.Truncate(horcruxPath, 0)
-
-		horcruxFile, err := os.OpenFile(horcruxPath, os.O_WRONLY|os.O_CREATE, 0644)
+		horcruxFile, err := createHorcruxFile(index)
 		if err != nil {
 			return err
 		}
-		defer horcruxFile.Close()
 
-		if _, err := horcruxFile.WriteString(header(index, total, headerBytes)); err != nil {
+		text := header(index, total, headerBytes)
+		if _, err := horcruxFile.WriteString(text); err != nil {
 			return err
 		}
 
 		horcruxFiles[i] = horcruxFile
+		headerOffsets[i] = int64(strings.Index(text, string(headerBytes)))
+		headerLengths[i] = len(headerBytes)
 	}
 
-	// wrap file reader in an encryption stream
-	var fileReader io.Reader = file
-	reader := cryptoReader(fileReader, key)
+	// wrap file reader in an encryption stream, taking a digest of the original
+	// content along the way so that bind can check it got the same thing back.
+	contentHash := sha256.New()
+	reader, err := encryption.NewEncrypter(io.TeeReader(r, contentHash), keys.body, noncePrefix)
+	if err != nil {
+		return err
+	}
 
-	var writer io.Writer
-	if threshold == total {
+	bodyWriters := make([]*bodyWriter, total)
+	writers := make([]io.Writer, total)
+	for i := range writers {
+		bodyWriters[i] = newBodyWriter(horcruxFiles[i], keys.mac)
+		writers[i] = bodyWriters[i]
+	}
+
+	var encryptedSize int64
+	switch bodyMode {
+	case BodyModeStriped:
 		// because we need all horcruxes to reconstitute the original file,
 		// we'll use a multiplexer to divide the encrypted content evenly between
 		// the horcruxes
-		writer = &multiplexing.Demultiplexer{Writers: horcruxFiles}
-	} else {
-		writers := make([]io.Writer, len(horcruxFiles))
-		for i := range writers {
-			writers[i] = horcruxFiles[i]
+		writer := &multiplexing.Demultiplexer{Writers: writers, StripeSize: format.stripeSize}
+		if encryptedSize, err = io.Copy(writer, reader); err != nil {
+			return err
 		}
-
-		writer = io.MultiWriter(writers...)
+	case BodyModeFullCopy:
+		writer := io.MultiWriter(writers...)
+		if encryptedSize, err = io.Copy(writer, reader); err != nil {
+			return err
+		}
+	case BodyModeErasure:
+		encoder, err := erasure.NewEncoder(writers, threshold, format.stripeSize)
+		if err != nil {
+			return err
+		}
+		if encryptedSize, err = io.Copy(encoder, reader); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown body mode %q", bodyMode)
 	}
 
-	_, err = io.Copy(writer, reader)
+	sealedContentDigest, err := encryption.SealMetadata(keys.metadata, noncePrefix, contentHash.Sum(nil))
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Done!")
+	for i, horcruxFile := range horcruxFiles {
+		headers[i].SealedContentDigest = sealedContentDigest
+		headers[i].EncryptedSize = encryptedSize
+		headers[i].BodySize = bodyWriters[i].size
+		headers[i].BodyDigest = bodyWriters[i].digest()
+		headerBytes, err := json.Marshal(&headers[i])
+		if err != nil {
+			return err
+		}
+
+		// pad with spaces to completely cover the placeholder
+		padded := append(headerBytes, bytes.Repeat([]byte(" "), headerLengths[i]-len(headerBytes))...)
+		if _, err := horcruxFile.WriteAt(padded, headerOffsets[i]); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func obtainTotalAndThreshold() (int, int, error) {
-	totalPtr := flag.Int("n", 0, "number of horcruxes to make")
-	thresholdPtr := flag.Int("t", 0, "number of horcruxes required to resurrect the original file")
-	flag.Parse()
+func defaultBodyMode(total int, threshold int, fullCopy bool) string {
+	if threshold == total {
+		return BodyModeStriped
+	}
+	if fullCopy {
+		return BodyModeFullCopy
+	}
+	return BodyModeErasure
+}
 
-	total := *totalPtr
-	threshold := *thresholdPtr
+func horcruxFilename(originalFilename string, index int, total int) string {
+	originalFilenameWithoutExt := strings.TrimSuffix(originalFilename, filepath.Ext(originalFilename))
+	if originalFilenameWithoutExt == "" {
+		// for something like .gnupg, we don't want to be left with nothing
+		// (or with horcruxes that are hidden away)
+		originalFilenameWithoutExt = strings.TrimPrefix(originalFilename, ".")
+	}
+	return fmt.Sprintf("%s_%d_of_%d.horcrux", originalFilenameWithoutExt, index, total)
+}
 
+// PromptForTotalAndThreshold asks the user for whichever of total and
+// threshold is zero
+func PromptForTotalAndThreshold(total int, threshold int) (int, int, error) {
 	if total == 0 {
 		totalStr := Prompt("How many horcruxes do you want to split this file into? (2-99): ")
 		var err error
@@ -144,7 +423,7 @@ func obtainTotalAndThreshold() (int, int, error) {
 	}
 
 	if threshold == 0 {
-		thresholdStr := Prompt("How many horcruxes should be required to reconstitute the original file? If you require all horcruxes, the resulting files will take up less space, but it will feel less magical (2-99): ")
+		thresholdStr := Prompt("How many horcruxes should be required to reconstitute the original file? If you require all horcruxes, it will feel less magical (2-99): ")
 		var err error
 		threshold, err = strconv.Atoi(thresholdStr)
 		if err != nil {
@@ -155,6 +434,24 @@ func obtainTotalAndThreshold() (int, int, error) {
 	return total, threshold, nil
 }
 
+// MaxHorcruxes is the most horcruxes a file can be split into, because each
+// horcrux's index is a point on a polynomial over GF(2^8)
+const MaxHorcruxes = 255
+
+// ValidateTotalAndThreshold checks that a file can be split into `total`
+// horcruxes, `threshold` of which are required to bind it
+func ValidateTotalAndThreshold(total int, threshold int) error {
+	switch {
+	case threshold < 2:
+		return fmt.Errorf("at least 2 horcruxes must be required to bind, not %d", threshold)
+	case threshold > total:
+		return fmt.Errorf("%d horcruxes can't be required to bind when there are only %d", threshold, total)
+	case total > MaxHorcruxes:
+		return fmt.Errorf("there can't be more than %d horcruxes, not %d", MaxHorcruxes, total)
+	}
+	return nil
+}
+
 func header(index int, total int, headerBytes []byte) string {
 	return fmt.Sprintf(`# THIS FILE IS A HORCRUX.
 # IT IS ONE OF %d HORCRUXES THAT EACH CONTAIN PART OF AN ORIGINAL FILE.
@@ -173,3 +470,11 @@ func generateKey() ([]byte, error) {
 	_, err := rand.Read(key)
 	return key, err
 }
+
+func generateSetID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
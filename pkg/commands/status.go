@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrSetsIncomplete is returned by Status when there's a set that doesn't have
+// enough horcruxes to be bound
+var ErrSetsIncomplete = errors.New("some sets of horcruxes can't be bound yet")
+
+// Status prints, for each set of horcruxes among the given paths, which
+// horcruxes of the set are present, which are missing, and whether there are
+// enough of them to bind the set. Nothing is decrypted: it's all worked out
+// from the headers, so it's quick enough to run over a whole backup drive
+// before you go looking for the rest.
+func Status(paths []string) error {
+	// a file without a valid header shouldn't stop us from reporting on the
+	// rest, but one we can't read at all might be a horcrux we'd be leaving out
+	readablePaths := []string{}
+	for _, path := range paths {
+		if _, err := NewHorcrux(path); err != nil {
+			if !errors.Is(err, ErrInvalidHeader) {
+				return err
+			}
+			fmt.Printf("%s: could not read horcrux: %s\n", path, err)
+			continue
+		}
+		readablePaths = append(readablePaths, path)
+	}
+
+	sets, err := GetHorcruxSets(readablePaths)
+	if err != nil {
+		return err
+	}
+
+	if len(sets) == 0 {
+		return &NotEnoughHorcruxesError{}
+	}
+
+	incomplete := 0
+	for i, set := range sets {
+		if i > 0 {
+			fmt.Println()
+		}
+		if !printSetStatus(set) {
+			incomplete++
+		}
+	}
+
+	if incomplete > 0 {
+		fmt.Printf("\n%d of %d sets can't be bound yet\n", incomplete, len(sets))
+		return ErrSetsIncomplete
+	}
+
+	return nil
+}
+
+// printSetStatus prints the status of a set and returns whether it can be bound
+func printSetStatus(set []Horcrux) bool {
+	header := set[0].GetHeader()
+
+	for _, horcrux := range set {
+		if err := checkTotalAndThreshold(horcrux); err != nil {
+			fmt.Println(describeSet(set))
+			fmt.Printf("  can't be bound: %s\n", err)
+			return false
+		}
+	}
+
+	present := make([]bool, header.Total+1)
+	for _, horcrux := range set {
+		if index := horcrux.GetHeader().Index; index >= 1 && index <= header.Total {
+			present[index] = true
+		}
+	}
+
+	presentIndices := []string{}
+	missingIndices := []string{}
+	for index := 1; index <= header.Total; index++ {
+		if present[index] {
+			presentIndices = append(presentIndices, strconv.Itoa(index))
+		} else {
+			missingIndices = append(missingIndices, strconv.Itoa(index))
+		}
+	}
+
+	fmt.Println(describeSet(set))
+	fmt.Printf("  present: %s\n", listOrNone(presentIndices))
+	fmt.Printf("  missing: %s\n", listOrNone(missingIndices))
+
+	have := len(presentIndices)
+	canBind := have >= header.Threshold
+	if canBind {
+		fmt.Printf("  can be bound: have %d horcruxes and %d are required\n", have, header.Threshold)
+	} else {
+		fmt.Printf("  can't be bound yet: have %d of the %d required horcruxes, need %d more\n", have, header.Threshold, header.Threshold-have)
+	}
+
+	if header.bodyMode() == BodyModeStriped {
+		fmt.Printf("  warning: every one of the %d horcruxes of this set is required to bind it, so if any of them is lost the original file is gone for good\n", header.Total)
+	}
+
+	return canBind
+}
+
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
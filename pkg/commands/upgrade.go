@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Upgrade re-encodes a set of horcruxes in the current format version. The
+// original file is resurrected in memory and streamed straight into a fresh
+// split with the same total and threshold, so it never touches the disk. The
+// supplied horcruxes are replaced in place, with the old ones kept next to
+// them as backups, and any horcruxes missing from the set are created
+// alongside the first one.
+func Upgrade(paths []string) error {
+	horcruxes, err := GetHorcruxes(paths)
+	if err != nil {
+		return err
+	}
+
+	if err := ValidateHorcruxes(horcruxes); err != nil {
+		return err
+	}
+
+	header := horcruxes[0].GetHeader()
+	if header.Version == CurrentVersion {
+		fmt.Printf("These horcruxes are already in the newest format (version %d). Nothing to do.\n", CurrentVersion)
+		return nil
+	}
+
+	// bind can get by with the key that most of the key fragments agree on, but
+	// v1 horcruxes aren't authenticated, so if that's the wrong key we'd seal
+	// garbage into horcruxes that check out from then on. We only upgrade when
+	// there's no doubt about the key.
+	if err := checkKeyFragmentsAgree(horcruxes); err != nil {
+		return fmt.Errorf("%w. Run `horcrux verify` to find out which, and leave it out", err)
+	}
+
+	// the upgraded horcruxes keep the filenames of the ones we were given
+	dstPaths := make([]string, header.Total)
+	for _, horcrux := range horcruxes {
+		dstPaths[horcrux.GetHeader().Index-1] = horcrux.GetPath()
+	}
+	dir := filepath.Dir(horcruxes[0].GetPath())
+	created := map[string]bool{}
+	// the old horcruxes are kept alongside the new ones until you're happy to
+	// delete them
+	backups := make([]string, header.Total)
+	for i := range dstPaths {
+		if dstPaths[i] != "" {
+			backups[i] = fmt.Sprintf("%s.v%d.bak", dstPaths[i], header.Version)
+			if fileExists(backups[i]) {
+				return fmt.Errorf("%s already exists. Please move it out of the way and try again", backups[i])
+			}
+			continue
+		}
+		dstPaths[i] = filepath.Join(dir, horcruxFilename(header.OriginalFilename, i+1, header.Total))
+		if fileExists(dstPaths[i]) {
+			return fmt.Errorf("%s already exists but is not one of the horcruxes being upgraded. Please move it out of the way and try again", dstPaths[i])
+		}
+		created[dstPaths[i]] = true
+	}
+
+	// we can't overwrite the old horcruxes while we're still reading from them
+	// so we write the new ones to temp files and only move them into place once
+	// every one of them has been written successfully.
+	tmpFiles := []*atomicFile{}
+	abort := func(files []*atomicFile) {
+		for _, tmpFile := range files {
+			tmpFile.Abort()
+		}
+	}
+
+	createHorcruxFile := func(index int) (*os.File, error) {
+		tmpFile, err := createAtomicFile(dstPaths[index-1], DefaultFileMode)
+		if err != nil {
+			return nil, err
+		}
+		tmpFiles = append(tmpFiles, tmpFile)
+		return tmpFile.File, nil
+	}
+
+	err = resurrectWithSpares(horcruxes, func(reader *checkedReader) error {
+		if err := split(reader, header.OriginalFilename, reader.fileInfo, header.Archive, header.Total, header.Threshold, defaultBodyMode(header.Total, header.Threshold, false), createHorcruxFile); err != nil {
+			abort(tmpFiles)
+			tmpFiles = nil
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// if we can't move every one of the new horcruxes into place, the old ones
+	// are all put back, rather than leaving a mix of the two that can't be bound
+	if err := commitAllKeeping(tmpFiles, backups); err != nil {
+		return err
+	}
+
+	for i := range tmpFiles {
+		if created[dstPaths[i]] {
+			fmt.Printf("created %s\n", dstPaths[i])
+		} else {
+			fmt.Printf("rewrote %s (the old horcrux is at %s)\n", dstPaths[i], backups[i])
+		}
+	}
+
+	fmt.Printf("Upgraded %d horcruxes from version %d to version %d\n", len(tmpFiles), header.Version, CurrentVersion)
+
+	return nil
+}
@@ -7,9 +7,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
 	"strings"
 )
 
+// cryptoReader is how bodies were encrypted before we switched to chunked
+// AES-GCM. It has no authentication (and a zero IV) so we only keep it around
+// for binding old horcruxes.
 func cryptoReader(r io.Reader, key []byte) io.Reader {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -30,9 +34,43 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
+// Messages is where binding tells the user what it's up to. If stdout is taken
+// up by something else, like the resurrected file, set it to stderr.
+var Messages io.Writer = os.Stdout
+
 func Prompt(message string, args ...interface{}) string {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Printf(message, args...)
 	input, _ := reader.ReadString('\n')
 	return strings.TrimSpace(input)
 }
+
+// StdinIsTerminal tells us whether there's somebody at the other end of stdin
+// to answer our prompts, rather than a pipe or a file. Without going outside
+// the standard library the best we can do is check for a character device,
+// which /dev/null also is.
+func StdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	devNull, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, devNull)
+}
+
+// warnIfWritableByOthers warns the user if somebody else can write to dir, as
+// depending on the directory they may be able to swap a file we resurrect there
+// for one of their own. Windows doesn't report directory permissions this way, so
+// there we can't tell.
+func warnIfWritableByOthers(dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		fmt.Fprintf(Messages, "warning: other users can write to %s, so they may be able to tamper with files resurrected there\n", dir)
+	}
+}
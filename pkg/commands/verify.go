@@ -0,0 +1,231 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	shardOK      = "OK"
+	shardCorrupt = "CORRUPT"
+	shardMissing = "MISSING"
+)
+
+var ErrVerificationFailed = errors.New("verification failed")
+
+type shardReport struct {
+	name   string
+	status string
+	detail string
+}
+
+// Verify checks that the horcruxes at the given paths can resurrect the
+// original file, without writing it anywhere: the headers must agree, the key
+// fragments must combine, and the whole body must decrypt and authenticate.
+// It prints a report for each horcrux of the set and returns
+// ErrVerificationFailed if any horcrux is corrupt or the set can't be bound.
+func Verify(paths []string) error {
+	reports := []shardReport{}
+
+	// a horcrux without a valid header is corrupt (and one that isn't there
+	// at all is missing), but that shouldn't stop us from checking the rest of
+	// them. One we can't read for any other reason can't be vouched for either
+	// way, so that's an error.
+	readablePaths := []string{}
+	missingPaths := []string{}
+	for _, path := range paths {
+		_, err := NewHorcrux(path)
+		switch {
+		case err == nil:
+			readablePaths = append(readablePaths, path)
+		case os.IsNotExist(err):
+			missingPaths = append(missingPaths, path)
+		case errors.Is(err, ErrInvalidHeader):
+			reports = append(reports, shardReport{name: path, status: shardCorrupt, detail: err.Error()})
+		default:
+			return err
+		}
+	}
+
+	horcruxes, err := GetHorcruxes(readablePaths)
+	if err != nil {
+		return err
+	}
+
+	setErr := verifySet(horcruxes, &reports)
+
+	// the set's own report already says which of its horcruxes are missing,
+	// so we only add the ones it doesn't mention
+	reported := map[string]bool{}
+	for _, report := range reports {
+		reported[filepath.Clean(report.name)] = true
+	}
+	for _, path := range missingPaths {
+		if !reported[filepath.Clean(path)] {
+			reports = append(reports, shardReport{name: path, status: shardMissing})
+		}
+	}
+
+	for _, report := range reports {
+		if report.detail == "" {
+			fmt.Printf("%s: %s\n", report.name, report.status)
+		} else {
+			fmt.Printf("%s: %s (%s)\n", report.name, report.status, report.detail)
+		}
+	}
+
+	if setErr != nil {
+		// being a horcrux or two short (or being given horcruxes from more
+		// than one set) isn't a sign that anything's corrupt
+		if !IsIntegrityError(setErr) {
+			return setErr
+		}
+		fmt.Println(setErr)
+		return ErrVerificationFailed
+	}
+
+	for _, report := range reports {
+		if report.status == shardCorrupt {
+			return ErrVerificationFailed
+		}
+	}
+
+	fmt.Println("All good!")
+
+	return nil
+}
+
+// verifySet appends a report for each horcrux in the set and returns an error
+// if the set as a whole can't be bound.
+func verifySet(horcruxes []Horcrux, reports *[]shardReport) error {
+	if err := ValidateHorcruxes(horcruxes); err != nil {
+		return err
+	}
+
+	header := horcruxes[0].GetHeader()
+	fmt.Printf("Verifying %s (%d of %d horcruxes required, format version %d)\n", display(header.OriginalFilename), header.Threshold, header.Total, header.Version)
+
+	format, err := getFormat(header.Version)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]shardReport, header.Total)
+	for i := range statuses {
+		name := filepath.Join(filepath.Dir(horcruxes[0].GetPath()), horcruxFilename(header.OriginalFilename, i+1, header.Total))
+		statuses[i] = shardReport{name: name, status: shardMissing}
+	}
+	for _, horcrux := range horcruxes {
+		statuses[horcrux.GetHeader().Index-1] = shardReport{name: horcrux.GetPath(), status: shardOK}
+	}
+
+	key, badKeyFragments, err := combineKey(horcruxes)
+	defer func() {
+		markCorrupt(statuses, badKeyFragments)
+		*reports = append(*reports, statuses...)
+	}()
+	if err != nil {
+		return err
+	}
+
+	keys, err := deriveKeys(key, header)
+	if err != nil {
+		return err
+	}
+
+	if format.bodyCipher == "" {
+		// old horcruxes have no authentication so there's no way of telling
+		// whether their contents are intact short of binding them and looking
+		for _, horcrux := range horcruxes {
+			statuses[horcrux.GetHeader().Index-1] = shardReport{name: horcrux.GetPath(), status: shardOK, detail: "header only: this format can't be authenticated, consider running `horcrux upgrade`"}
+		}
+		return nil
+	}
+
+	if header.bodyMode() != BodyModeFullCopy {
+		// in striped and erasure coded modes each horcrux only holds part of
+		// the body, so we have to check them together, relying on the digest in
+		// each header to tell us which one is at fault.
+		reader, err := originalContentReader(horcruxes, key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, reader)
+
+		corruptBodies := []error{}
+		for _, horcrux := range horcruxes {
+			statuses[horcrux.GetHeader().Index-1] = shardReport{name: horcrux.GetPath(), status: shardOK}
+
+			// any horcruxes beyond the threshold weren't needed to decode the
+			// body, but we can still check them against their own digest.
+			if !reader.usesBodyOf(horcrux) {
+				if bodyErr := newBodyReader(horcrux, keys.mac).check(); bodyErr != nil {
+					corruptBodies = append(corruptBodies, bodyErr)
+				}
+			}
+		}
+		if err == nil {
+			markCorrupt(statuses, corruptBodies)
+			return nil
+		}
+
+		corruptBodies = append(corruptBodies, reader.corruptBodies()...)
+		markCorrupt(statuses, corruptBodies)
+		if len(corruptBodies) == 0 {
+			for i := range statuses {
+				statuses[i].status = shardCorrupt
+			}
+			return fmt.Errorf("the body is striped across every horcrux and we can't tell which one is at fault: %s", err)
+		}
+		return nil
+	}
+
+	// in full-copy mode each horcrux holds the entire body so we can check them
+	// one at a time.
+	ok := 0
+	for _, horcrux := range horcruxes {
+		report := shardReport{name: horcrux.GetPath(), status: shardOK}
+		body := newBodyReader(horcrux, keys.mac)
+		reader, err := bodyDecrypter(body, keys, format, horcrux.GetHeader())
+		if err == nil {
+			var checked *checkedReader
+			checked, err = newCheckedReader(reader, []*bodyReader{body}, keys, horcrux.GetHeader())
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, checked)
+			}
+		}
+		if err != nil {
+			report.status = shardCorrupt
+			report.detail = err.Error()
+			if corruptErr, isCorrupt := err.(*CorruptHorcruxError); isCorrupt {
+				report.detail = corruptErr.Problem
+			}
+		} else {
+			ok++
+		}
+		statuses[horcrux.GetHeader().Index-1] = report
+	}
+
+	if ok == 0 {
+		return errors.New("no horcrux could be decrypted with the combined key: a key fragment may be corrupt")
+	}
+
+	return nil
+}
+
+func markCorrupt(statuses []shardReport, corruptBodies []error) {
+	for _, corruptErr := range corruptBodies {
+		if corruptErr, ok := corruptErr.(*CorruptHorcruxError); ok {
+			for i := range statuses {
+				if statuses[i].name == corruptErr.Path {
+					statuses[i].status = shardCorrupt
+					statuses[i].detail = corruptErr.Problem
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package encryption
+
+// This file contains readers for encrypting and decrypting a stream in
+// fixed-size chunks with AES-GCM. Each chunk is authenticated on its own, and
+// the final chunk is flagged as such in its nonce, so flipping a bit anywhere
+// in the stream, reordering chunks, or truncating the stream are all detected
+// rather than silently producing garbage.
+//
+// The nonce for each chunk is made up of a random per-stream prefix, a chunk
+// counter and a final-chunk flag:
+// | prefix (7 bytes) | counter (4 bytes, big endian) | final flag (1 byte) |
+//
+// Small pieces of metadata that belong to the stream can be sealed with the
+// same key and prefix: they get a flag of their own so their nonces never
+// collide with those of the chunks.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// ChunkSize is the number of plaintext bytes encrypted per chunk
+	ChunkSize = 64 * 1024
+
+	// NoncePrefixSize is the size of the random per-stream nonce prefix
+	NoncePrefixSize = 7
+
+	// Overhead is the number of bytes sealing adds to each chunk and to
+	// each piece of metadata
+	Overhead = 16
+
+	nonceSize = NoncePrefixSize + 4 + 1
+)
+
+var (
+	// ErrCorrupt is returned when a chunk fails authentication
+	ErrCorrupt = errors.New("encrypted content failed authentication: it has been corrupted or tampered with")
+
+	// ErrTruncated is returned when the stream ends before its final chunk
+	ErrTruncated = errors.New("encrypted content is truncated")
+
+	// ErrTrailingData is returned when there's more to the stream after its
+	// final chunk
+	ErrTrailingData = errors.New("encrypted content has unexpected data after its final chunk")
+
+	errTooManyChunks = errors.New("content is too large to encrypt")
+)
+
+// GenerateNoncePrefix returns a random nonce prefix. A new prefix must be used
+// for every stream encrypted with the same key.
+func GenerateNoncePrefix() ([]byte, error) {
+	prefix := make([]byte, NoncePrefixSize)
+	_, err := rand.Read(prefix)
+	return prefix, err
+}
+
+type chunker struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	done        bool
+	buf         []byte
+	// pending holds processed bytes that have not yet been handed to the caller
+	pending []byte
+}
+
+func newChunker(key []byte, noncePrefix []byte) (*chunker, error) {
+	if len(noncePrefix) != NoncePrefixSize {
+		return nil, errors.New("invalid nonce prefix")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunker{
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		buf:         make([]byte, ChunkSize+Overhead),
+	}, nil
+}
+
+const metadataFlag = 2
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func metadataNonce(noncePrefix []byte) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, noncePrefix)
+	nonce[nonceSize-1] = metadataFlag
+	return nonce
+}
+
+// SealMetadata encrypts and authenticates a small piece of metadata belonging
+// to the stream with the given key and nonce prefix. Only one piece of
+// metadata may be sealed per stream.
+func SealMetadata(key []byte, noncePrefix []byte, metadata []byte) ([]byte, error) {
+	if len(noncePrefix) != NoncePrefixSize {
+		return nil, errors.New("invalid nonce prefix")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, metadataNonce(noncePrefix), metadata, nil), nil
+}
+
+// OpenMetadata reverses SealMetadata, returning ErrCorrupt if the sealed
+// metadata has been tampered with or the key is wrong.
+func OpenMetadata(key []byte, noncePrefix []byte, sealed []byte) ([]byte, error) {
+	if len(noncePrefix) != NoncePrefixSize {
+		return nil, errors.New("invalid nonce prefix")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := aead.Open(nil, metadataNonce(noncePrefix), sealed, nil)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return metadata, nil
+}
+
+// nonce returns the nonce for the current chunk and moves on to the next one
+func (c *chunker) nonce(final bool) ([]byte, error) {
+	nonce, err := c.currentNonce(final)
+	if err != nil {
+		return nil, err
+	}
+	c.counter++
+
+	return nonce, nil
+}
+
+func (c *chunker) currentNonce(final bool) ([]byte, error) {
+	if c.counter == ^uint32(0) {
+		return nil, errTooManyChunks
+	}
+
+	nonce := make([]byte, nonceSize)
+	copy(nonce, c.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[NoncePrefixSize:], c.counter)
+	if final {
+		nonce[nonceSize-1] = 1
+	}
+
+	return nonce, nil
+}
+
+// read hands over pending bytes, calling fill whenever we run out
+func (c *chunker) read(p []byte, fill func() error) (int, error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+type encrypter struct {
+	*chunker
+	r io.Reader
+}
+
+// NewEncrypter returns a reader of the encrypted contents of r
+func NewEncrypter(r io.Reader, key []byte, noncePrefix []byte) (io.Reader, error) {
+	c, err := newChunker(key, noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encrypter{chunker: c, r: r}, nil
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	return e.read(p, e.fill)
+}
+
+func (e *encrypter) fill() error {
+	n, err := io.ReadFull(e.r, e.buf[:ChunkSize])
+	// a full chunk is never the final chunk: if the content happens to be a
+	// multiple of the chunk size we'll follow up with an empty final chunk.
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+
+	nonce, err := e.nonce(final)
+	if err != nil {
+		return err
+	}
+
+	e.pending = e.aead.Seal(e.buf[:0], nonce, e.buf[:n], nil)
+	e.done = final
+	return nil
+}
+
+type decrypter struct {
+	*chunker
+	r io.Reader
+}
+
+// NewDecrypter returns a reader of the decrypted contents of r. Read returns
+// ErrCorrupt or ErrTruncated if r has been tampered with.
+func NewDecrypter(r io.Reader, key []byte, noncePrefix []byte) (io.Reader, error) {
+	c, err := newChunker(key, noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decrypter{chunker: c, r: r}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	return d.read(p, d.fill)
+}
+
+func (d *decrypter) fill() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	final := false
+	if err == io.EOF {
+		// every stream ends with a final chunk, even if it's empty
+		return ErrTruncated
+	} else if err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+
+	nonce, err := d.nonce(final)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := d.aead.Open(d.buf[:0], nonce, d.buf[:n], nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+
+	if final {
+		var extra [1]byte
+		if n, _ := d.r.Read(extra[:]); n > 0 {
+			return ErrTrailingData
+		}
+	}
+
+	d.pending = plaintext
+	d.done = final
+	return nil
+}
+
+type repairingDecrypter struct {
+	*chunker
+	copies   []io.ReaderAt
+	onRepair func(chunk int, from int)
+}
+
+// NewRepairingDecrypter returns a reader of the decrypted contents of several
+// identical copies of an encrypted stream. Chunks are read from the first copy,
+// but whenever one of its chunks fails authentication (or is missing) we take
+// that chunk from the next copy whose chunk does authenticate, and call
+// onRepair with the index of the chunk and of the copy it was taken from. Read
+// only fails if no copy has a good version of a chunk.
+func NewRepairingDecrypter(copies []io.ReaderAt, key []byte, noncePrefix []byte, onRepair func(chunk int, from int)) (io.Reader, error) {
+	if len(copies) == 0 {
+		return nil, errors.New("no copies to decrypt")
+	}
+
+	c, err := newChunker(key, noncePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repairingDecrypter{chunker: c, copies: copies, onRepair: onRepair}, nil
+}
+
+func (d *repairingDecrypter) Read(p []byte) (int, error) {
+	return d.read(p, d.fill)
+}
+
+func (d *repairingDecrypter) fill() error {
+	chunk := int(d.counter)
+	offset := int64(d.counter) * int64(len(d.buf))
+
+	var lastErr error
+	for i, c := range d.copies {
+		n, err := c.ReadAt(d.buf, offset)
+		if err != nil && err != io.EOF {
+			lastErr = err
+			continue
+		}
+		if n == 0 {
+			// every stream ends with a final chunk, even if it's empty
+			lastErr = ErrTruncated
+			continue
+		}
+
+		// whether this is the final chunk is up to each copy: a copy that's
+		// been truncated will think so, and fail authentication accordingly.
+		final := n < len(d.buf)
+		nonce, err := d.currentNonce(final)
+		if err != nil {
+			return err
+		}
+
+		plaintext, err := d.aead.Open(d.buf[:0], nonce, d.buf[:n], nil)
+		if err != nil {
+			lastErr = ErrCorrupt
+			continue
+		}
+
+		if i > 0 && d.onRepair != nil {
+			d.onRepair(chunk, i)
+		}
+
+		d.counter++
+		d.pending = plaintext
+		d.done = final
+		return nil
+	}
+
+	return lastErr
+}
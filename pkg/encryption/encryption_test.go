@@ -0,0 +1,268 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// sealedChunkSize is the size of every chunk of an encrypted stream bar the last
+const sealedChunkSize = ChunkSize + Overhead
+
+var testSizes = []int{0, 1, 100, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testKeyAndPrefix(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	prefix, err := GenerateNoncePrefix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return randomBytes(t, 32), prefix
+}
+
+func encrypt(t *testing.T, plaintext []byte, key []byte, prefix []byte) []byte {
+	t.Helper()
+	r, err := NewEncrypter(bytes.NewReader(plaintext), key, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func decrypt(sealed []byte, key []byte, prefix []byte) ([]byte, error) {
+	r, err := NewDecrypter(bytes.NewReader(sealed), key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+
+	for _, size := range testSizes {
+		plaintext := randomBytes(t, size)
+		sealed := encrypt(t, plaintext, key, prefix)
+
+		// a stream always ends with a final chunk, which is empty if the
+		// content is a multiple of the chunk size
+		chunks := size/ChunkSize + 1
+		if expected := size + chunks*Overhead; len(sealed) != expected {
+			t.Errorf("size %d: expected %d encrypted bytes, got %d", size, expected, len(sealed))
+		}
+
+		decrypted, err := decrypt(sealed, key, prefix)
+		if err != nil {
+			t.Errorf("size %d: %s", size, err)
+			continue
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: decrypted content does not match", size)
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+	sealed := encrypt(t, randomBytes(t, 100), key, prefix)
+
+	otherKey, otherPrefix := testKeyAndPrefix(t)
+	if _, err := decrypt(sealed, otherKey, prefix); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt with the wrong key, got %v", err)
+	}
+	if _, err := decrypt(sealed, key, otherPrefix); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt with the wrong nonce prefix, got %v", err)
+	}
+}
+
+func TestBitFlip(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+	sealed := encrypt(t, randomBytes(t, 2*ChunkSize+10), key, prefix)
+
+	for _, offset := range []int{0, sealedChunkSize - 1, sealedChunkSize + 7, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[offset] ^= 1
+		if _, err := decrypt(tampered, key, prefix); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("offset %d: expected ErrCorrupt, got %v", offset, err)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+
+	for _, size := range testSizes {
+		sealed := encrypt(t, randomBytes(t, size), key, prefix)
+
+		// cutting the stream off at a chunk boundary leaves no final chunk,
+		// and cutting it off anywhere else leaves a final chunk that doesn't
+		// authenticate
+		for _, cut := range []int{0, 1, sealedChunkSize, len(sealed) - 1} {
+			if cut >= len(sealed) {
+				continue
+			}
+			_, err := decrypt(sealed[:cut], key, prefix)
+			if !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrCorrupt) {
+				t.Errorf("size %d cut to %d: expected ErrTruncated or ErrCorrupt, got %v", size, cut, err)
+			}
+		}
+	}
+
+	sealed := encrypt(t, randomBytes(t, 2*ChunkSize+10), key, prefix)
+	if _, err := decrypt(sealed[:2*sealedChunkSize], key, prefix); !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated without the final chunk, got %v", err)
+	}
+}
+
+func TestReordering(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+	sealed := encrypt(t, randomBytes(t, 2*ChunkSize+10), key, prefix)
+
+	first := sealed[:sealedChunkSize]
+	second := sealed[sealedChunkSize : 2*sealedChunkSize]
+	rest := sealed[2*sealedChunkSize:]
+
+	swapped := append(append(append([]byte{}, second...), first...), rest...)
+	if _, err := decrypt(swapped, key, prefix); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt with chunks swapped, got %v", err)
+	}
+
+	duplicated := append(append(append([]byte{}, first...), first...), rest...)
+	if _, err := decrypt(duplicated, key, prefix); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt with a chunk duplicated, got %v", err)
+	}
+
+	// a full chunk can't pass itself off as the final one
+	if _, err := decrypt(sealed[:sealedChunkSize], key, prefix); err == nil {
+		t.Error("expected an error with only the first chunk")
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+
+	for _, size := range testSizes {
+		sealed := encrypt(t, randomBytes(t, size), key, prefix)
+
+		for _, extra := range [][]byte{{0}, sealed[len(sealed)-Overhead:], sealed} {
+			tampered := append(append([]byte{}, sealed...), extra...)
+			_, err := decrypt(tampered, key, prefix)
+			if !errors.Is(err, ErrTrailingData) && !errors.Is(err, ErrCorrupt) {
+				t.Errorf("size %d with %d extra bytes: expected ErrTrailingData or ErrCorrupt, got %v", size, len(extra), err)
+			}
+		}
+	}
+
+	// a stream that carries on after its final chunk has been read in full
+	sealed := encrypt(t, randomBytes(t, 10), key, prefix)
+	r, err := NewDecrypter(&pausingReader{parts: [][]byte{sealed, {1, 2, 3}}}, key, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrTrailingData) {
+		t.Errorf("expected ErrTrailingData, got %v", err)
+	}
+}
+
+// pausingReader returns io.EOF at the end of each of its parts, like a file
+// that's still being appended to
+type pausingReader struct {
+	parts [][]byte
+}
+
+func (p *pausingReader) Read(b []byte) (int, error) {
+	if len(p.parts) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.parts[0])
+	p.parts[0] = p.parts[0][n:]
+	if len(p.parts[0]) == 0 {
+		p.parts = p.parts[1:]
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestMetadata(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+	metadata := []byte("some metadata")
+
+	sealed, err := SealMetadata(key, prefix, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenMetadata(key, prefix, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, metadata) {
+		t.Errorf("expected %q, got %q", metadata, opened)
+	}
+
+	sealed[0] ^= 1
+	if _, err := OpenMetadata(key, prefix, sealed); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+
+	// sealed metadata can't pass itself off as a stream
+	sealed[0] ^= 1
+	if _, err := decrypt(sealed, key, prefix); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt decrypting metadata as a stream, got %v", err)
+	}
+}
+
+func TestRepairingDecrypter(t *testing.T) {
+	key, prefix := testKeyAndPrefix(t)
+	plaintext := randomBytes(t, 3*ChunkSize+5)
+	sealed := encrypt(t, plaintext, key, prefix)
+
+	damaged := append([]byte{}, sealed...)
+	damaged[sealedChunkSize+3] ^= 1
+	truncated := sealed[:len(sealed)-1]
+
+	repairs := [][2]int{}
+	onRepair := func(chunk int, from int) {
+		repairs = append(repairs, [2]int{chunk, from})
+	}
+
+	copies := []io.ReaderAt{bytes.NewReader(damaged), bytes.NewReader(truncated), bytes.NewReader(sealed)}
+	r, err := NewRepairingDecrypter(copies, key, prefix, onRepair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("repaired content does not match")
+	}
+	if len(repairs) != 1 || repairs[0] != [2]int{1, 1} {
+		t.Errorf("expected chunk 1 to be repaired from copy 1, got %v", repairs)
+	}
+
+	// when every copy of a chunk is damaged there's nothing to repair it with
+	r, err = NewRepairingDecrypter([]io.ReaderAt{bytes.NewReader(damaged), bytes.NewReader(damaged)}, key, prefix, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package encryption
+
+// HKDF (RFC 5869) with SHA-256, for deriving a separate key for each purpose
+// from a single master key, so that the same key material is never used for
+// two different things (say, encrypting the body and authenticating it).
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// SaltSize is the size of the random per-set salt keys are derived with
+const SaltSize = 32
+
+// GenerateSalt returns a random salt for DeriveKey
+func GenerateSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// DeriveKey derives a key of the given length from the master key and salt.
+// The label says what the key is for: keys derived with different labels are
+// independent of each other, so every purpose must have a label of its own.
+func DeriveKey(masterKey []byte, salt []byte, label string, length int) ([]byte, error) {
+	if length > 255*sha256.Size {
+		return nil, errors.New("derived key is too long")
+	}
+
+	// extract
+	extractor := hmac.New(sha256.New, salt)
+	extractor.Write(masterKey)
+	pseudoRandomKey := extractor.Sum(nil)
+
+	// expand
+	expander := hmac.New(sha256.New, pseudoRandomKey)
+	key := make([]byte, 0, length+sha256.Size)
+	var block []byte
+	for counter := byte(1); len(key) < length; counter++ {
+		expander.Reset()
+		expander.Write(block)
+		expander.Write([]byte(label))
+		expander.Write([]byte{counter})
+		block = expander.Sum(nil)
+		key = append(key, block...)
+	}
+
+	return key[:length], nil
+}
@@ -0,0 +1,93 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func byteRange(from int, to int) []byte {
+	b := []byte{}
+	for i := from; i < to; i++ {
+		b = append(b, byte(i))
+	}
+	return b
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// the SHA-256 test cases from appendix A of RFC 5869
+func TestDeriveKeyRFC5869(t *testing.T) {
+	tests := []struct {
+		name   string
+		ikm    []byte
+		salt   []byte
+		info   []byte
+		length int
+		okm    string
+	}{
+		{
+			name:   "basic",
+			ikm:    bytes.Repeat([]byte{0x0b}, 22),
+			salt:   byteRange(0x00, 0x0d),
+			info:   byteRange(0xf0, 0xfa),
+			length: 42,
+			okm:    "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			name:   "longer inputs and outputs",
+			ikm:    byteRange(0x00, 0x50),
+			salt:   byteRange(0x60, 0xb0),
+			info:   byteRange(0xb0, 0x100),
+			length: 82,
+			okm:    "b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c19afa97c59045a99cac7827271cb41c65e590e09da3275600c2f09b8367793a9aca3db71cc30c58179ec3e87c14c01d5c1f3434f1d87",
+		},
+		{
+			name:   "zero-length salt and info",
+			ikm:    bytes.Repeat([]byte{0x0b}, 22),
+			salt:   nil,
+			info:   nil,
+			length: 42,
+			okm:    "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+
+	for _, test := range tests {
+		key, err := DeriveKey(test.ikm, test.salt, string(test.info), test.length)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if expected := fromHex(t, test.okm); !bytes.Equal(key, expected) {
+			t.Errorf("%s: expected %x, got %x", test.name, expected, key)
+		}
+	}
+}
+
+func TestDeriveKeyLabels(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{1}, 32)
+	salt := bytes.Repeat([]byte{2}, SaltSize)
+
+	a, err := DeriveKey(masterKey, salt, "a", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DeriveKey(masterKey, salt, "b", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("keys derived with different labels are the same")
+	}
+
+	if _, err := DeriveKey(masterKey, salt, "a", 255*32+1); err == nil {
+		t.Error("expected an error deriving a key that's too long")
+	}
+}
@@ -0,0 +1,295 @@
+package erasure
+
+// When the threshold is less than the total number of horcruxes, we don't want
+// every horcrux to hold a full copy of the encrypted contents. Instead we
+// use a systematic Reed-Solomon code: the content is divided into stripes,
+// each stripe is divided between the first `threshold` horcruxes (just like
+// the multiplexer does), and the remaining horcruxes get parity computed from
+// those. Any `threshold` horcruxes are then enough to recover the content, and
+// each horcrux only holds about 1/threshold of it.
+//
+// Each horcrux's index doubles as its x coordinate when we treat the bytes at
+// the same offset of each horcrux's part of a stripe as points on a polynomial.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jesseduffield/horcrux/pkg/shamir"
+)
+
+func min(a int, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
+
+func max(a int, b int) int {
+	if a < b {
+		return b
+	}
+	return a
+}
+
+// shardLen returns how many bytes of a stripe that's `used` bytes full go to
+// the shard at the given (zero-based) index. Data shards get their own slice
+// of the stripe, and parity shards are as long as the longest data shard.
+func shardLen(index int, used int, threshold int, stripeSize int) int {
+	if index < threshold {
+		return max(0, min(used-index*stripeSize, stripeSize))
+	}
+	return min(used, stripeSize)
+}
+
+// ShardSize returns how many bytes the shard at the given (zero-based) index
+// ends up with when `size` bytes are erasure coded
+func ShardSize(index int, threshold int, stripeSize int, size int64) int64 {
+	stripeBytes := int64(threshold * stripeSize)
+	fullStripes := size / stripeBytes
+	return fullStripes*int64(stripeSize) + int64(shardLen(index, int(size%stripeBytes), threshold, stripeSize))
+}
+
+func validate(total int, threshold int, stripeSize int) error {
+	if threshold < 1 || threshold > total {
+		return fmt.Errorf("invalid threshold %d for %d shards", threshold, total)
+	}
+	if total > 255 {
+		return errors.New("cannot have more than 255 shards")
+	}
+	if stripeSize < 1 {
+		return errors.New("stripe size must be positive")
+	}
+	return nil
+}
+
+type Encoder struct {
+	writers       []io.Writer
+	threshold     int
+	stripeSize    int
+	stripe        []byte
+	filled        int
+	parity        []byte
+	interpolators []*shamir.Interpolator
+}
+
+// NewEncoder returns a writer that erasure codes what's written to it across
+// the given writers (one per shard, in order of index). Close must be called
+// once everything has been written, to flush the final stripe.
+func NewEncoder(writers []io.Writer, threshold int, stripeSize int) (*Encoder, error) {
+	if err := validate(len(writers), threshold, stripeSize); err != nil {
+		return nil, err
+	}
+
+	dataX := make([]uint8, threshold)
+	for i := range dataX {
+		dataX[i] = uint8(i + 1)
+	}
+
+	interpolators := make([]*shamir.Interpolator, len(writers)-threshold)
+	for i := range interpolators {
+		interpolator, err := shamir.NewInterpolator(dataX, uint8(threshold+i+1))
+		if err != nil {
+			return nil, err
+		}
+		interpolators[i] = interpolator
+	}
+
+	return &Encoder{
+		writers:       writers,
+		threshold:     threshold,
+		stripeSize:    stripeSize,
+		stripe:        make([]byte, threshold*stripeSize),
+		parity:        make([]byte, stripeSize),
+		interpolators: interpolators,
+	}, nil
+}
+
+func (e *Encoder) Write(p []byte) (int, error) {
+	totalN := 0
+	for len(p) > 0 {
+		n := copy(e.stripe[e.filled:], p)
+		e.filled += n
+		totalN += n
+		p = p[n:]
+		if e.filled == len(e.stripe) {
+			if err := e.flush(); err != nil {
+				return totalN, err
+			}
+		}
+	}
+
+	return totalN, nil
+}
+
+// Close flushes the final, partially filled stripe. It does not close the
+// underlying writers.
+func (e *Encoder) Close() error {
+	if e.filled == 0 {
+		return nil
+	}
+	return e.flush()
+}
+
+func (e *Encoder) flush() error {
+	// parity is computed as if the stripe was padded out with zeros
+	for i := e.filled; i < len(e.stripe); i++ {
+		e.stripe[i] = 0
+	}
+
+	samples := make([][]byte, e.threshold)
+	for i := range samples {
+		samples[i] = e.stripe[i*e.stripeSize : (i+1)*e.stripeSize]
+	}
+
+	for i, writer := range e.writers {
+		n := shardLen(i, e.filled, e.threshold, e.stripeSize)
+		var data []byte
+		if i < e.threshold {
+			data = samples[i][:n]
+		} else {
+			data = e.parity[:n]
+			e.interpolators[i-e.threshold].Interpolate(data, samples)
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+
+	e.filled = 0
+	return nil
+}
+
+type Decoder struct {
+	readers       []io.Reader
+	indices       []int
+	threshold     int
+	stripeSize    int
+	remaining     int64
+	samples       [][]byte
+	stripe        []byte
+	pending       []byte
+	interpolators map[int]*shamir.Interpolator
+}
+
+// NewDecoder returns a reader of the content that was erasure coded into
+// `size` bytes across the given readers (one per shard, in order of index,
+// with nil for any that are missing). Only the first `threshold` readers that
+// are present are read from.
+func NewDecoder(readers []io.Reader, threshold int, stripeSize int, size int64) (*Decoder, error) {
+	if err := validate(len(readers), threshold, stripeSize); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+
+	indices := []int{}
+	for i, reader := range readers {
+		if reader != nil && len(indices) < threshold {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) < threshold {
+		return nil, fmt.Errorf("%d shards are required to decode but only %d are present", threshold, len(indices))
+	}
+
+	sampleX := make([]uint8, threshold)
+	for i, index := range indices {
+		sampleX[i] = uint8(index + 1)
+	}
+
+	// any data shard we aren't reading from has to be interpolated
+	interpolators := map[int]*shamir.Interpolator{}
+	for i := 0; i < threshold; i++ {
+		if readers[i] != nil {
+			// the first `threshold` shards are all data shards, so if a data
+			// shard is present we're reading from it.
+			continue
+		}
+		interpolator, err := shamir.NewInterpolator(sampleX, uint8(i+1))
+		if err != nil {
+			return nil, err
+		}
+		interpolators[i] = interpolator
+	}
+
+	samples := make([][]byte, threshold)
+	for i := range samples {
+		samples[i] = make([]byte, stripeSize)
+	}
+
+	return &Decoder{
+		readers:       readers,
+		indices:       indices,
+		threshold:     threshold,
+		stripeSize:    stripeSize,
+		remaining:     size,
+		samples:       samples,
+		stripe:        make([]byte, threshold*stripeSize),
+		interpolators: interpolators,
+	}, nil
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.remaining == 0 {
+			return 0, io.EOF
+		}
+		if err := d.decodeStripe(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *Decoder) missingBefore(index int) int {
+	missing := 0
+	for i := 0; i < index; i++ {
+		if _, ok := d.interpolators[i]; ok {
+			missing++
+		}
+	}
+	return missing
+}
+
+func (d *Decoder) decodeStripe() error {
+	used := len(d.stripe)
+	if int64(used) > d.remaining {
+		used = int(d.remaining)
+	}
+
+	for i, index := range d.indices {
+		n := shardLen(index, used, d.threshold, d.stripeSize)
+		if _, err := io.ReadFull(d.readers[index], d.samples[i][:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		for j := n; j < d.stripeSize; j++ {
+			d.samples[i][j] = 0
+		}
+	}
+
+	for i := 0; i < d.threshold; i++ {
+		data := d.stripe[i*d.stripeSize : (i+1)*d.stripeSize]
+		if interpolator, ok := d.interpolators[i]; ok {
+			interpolator.Interpolate(data, d.samples)
+		} else {
+			// we're reading from every data shard that's present, and data
+			// shards come before parity shards, so this one is the i'th sample
+			// minus however many data shards before it are missing.
+			copy(data, d.samples[i-d.missingBefore(i)])
+		}
+	}
+
+	d.pending = d.stripe[:used]
+	d.remaining -= int64(used)
+	return nil
+}
@@ -0,0 +1,168 @@
+package erasure
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+const testStripeSize = 4
+
+// testSizes returns content sizes that end in every kind of stripe: none at
+// all, one that's only partly filled, one that ends partway through a data
+// shard, one that ends at a shard boundary and one that's full
+func testSizes(threshold int) []int {
+	stripe := threshold * testStripeSize
+	return []int{0, 1, testStripeSize - 1, testStripeSize, testStripeSize + 1, stripe - 1, stripe, stripe + 1, 3*stripe + testStripeSize + 2}
+}
+
+func encode(t *testing.T, content []byte, total int, threshold int) [][]byte {
+	t.Helper()
+	buffers := make([]*bytes.Buffer, total)
+	writers := make([]io.Writer, total)
+	for i := range buffers {
+		buffers[i] = &bytes.Buffer{}
+		writers[i] = buffers[i]
+	}
+
+	encoder, err := NewEncoder(writers, threshold, testStripeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in awkward pieces, so that stripes are filled over several writes
+	for remaining := content; len(remaining) > 0; {
+		n := 3
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		if _, err := encoder.Write(remaining[:n]); err != nil {
+			t.Fatal(err)
+		}
+		remaining = remaining[n:]
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	shards := make([][]byte, total)
+	for i := range buffers {
+		shards[i] = buffers[i].Bytes()
+	}
+	return shards
+}
+
+func decode(shards [][]byte, present []bool, threshold int, size int) ([]byte, error) {
+	readers := make([]io.Reader, len(shards))
+	for i := range shards {
+		if present[i] {
+			readers[i] = bytes.NewReader(shards[i])
+		}
+	}
+
+	decoder, err := NewDecoder(readers, threshold, testStripeSize, int64(size))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(decoder)
+}
+
+// subsets returns every way of choosing k of n shards
+func subsets(n int, k int) [][]bool {
+	result := [][]bool{}
+	for mask := 0; mask < 1<<uint(n); mask++ {
+		present := make([]bool, n)
+		count := 0
+		for i := range present {
+			if mask&(1<<uint(i)) != 0 {
+				present[i] = true
+				count++
+			}
+		}
+		if count == k {
+			result = append(result, present)
+		}
+	}
+	return result
+}
+
+func TestEveryChoiceOfShards(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for total := 1; total <= 5; total++ {
+		for threshold := 1; threshold <= total; threshold++ {
+			for _, size := range testSizes(threshold) {
+				content := make([]byte, size)
+				random.Read(content)
+
+				shards := encode(t, content, total, threshold)
+
+				for i, shard := range shards {
+					if expected := ShardSize(i, threshold, testStripeSize, int64(size)); int64(len(shard)) != expected {
+						t.Errorf("%d of %d, size %d: expected shard %d to be %d bytes, got %d", threshold, total, size, i, expected, len(shard))
+					}
+				}
+
+				for _, present := range subsets(total, threshold) {
+					name := fmt.Sprintf("%d of %d, size %d, shards %v", threshold, total, size, present)
+					decoded, err := decode(shards, present, threshold, size)
+					if err != nil {
+						t.Errorf("%s: %s", name, err)
+						continue
+					}
+					if !bytes.Equal(decoded, content) {
+						t.Errorf("%s: decoded content does not match", name)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeWithMoreShardsThanNeeded(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	shards := encode(t, content, 5, 3)
+
+	decoded, err := decode(shards, []bool{true, false, true, true, true}, 3, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, content) {
+		t.Error("decoded content does not match")
+	}
+}
+
+func TestDecodeTruncatedShard(t *testing.T) {
+	content := bytes.Repeat([]byte{7}, 50)
+	shards := encode(t, content, 3, 2)
+	shards[1] = shards[1][:len(shards[1])-1]
+
+	if _, err := decode(shards, []bool{true, true, false}, 2, len(content)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	writers := []io.Writer{ioutil.Discard, ioutil.Discard, ioutil.Discard}
+	for _, threshold := range []int{0, 4} {
+		if _, err := NewEncoder(writers, threshold, testStripeSize); err == nil {
+			t.Errorf("expected an error for a threshold of %d with 3 shards", threshold)
+		}
+	}
+	if _, err := NewEncoder(writers, 2, 0); err == nil {
+		t.Error("expected an error for a stripe size of 0")
+	}
+	if _, err := NewEncoder(make([]io.Writer, 256), 2, testStripeSize); err == nil {
+		t.Error("expected an error for 256 shards")
+	}
+
+	shards := encode(t, []byte("content"), 3, 2)
+	if _, err := decode(shards, []bool{true, false, false}, 2, 7); err == nil {
+		t.Error("expected an error with too few shards")
+	}
+	if _, err := decode(shards, []bool{true, true, true}, 2, -1); err == nil {
+		t.Error("expected an error for a negative size")
+	}
+}
@@ -5,8 +5,10 @@ package multiplexing
 // This file contains a multiplexer/Demultiplexer for reading/writing with
 // multiplexed content
 
-import "os"
+import "io"
 
+// BYTE_QUOTA is the default number of bytes given to each horcrux before moving
+// on to the next one. Set StripeSize to use something else.
 const BYTE_QUOTA = 100
 
 func min(a int, b int) int {
@@ -16,8 +18,16 @@ func min(a int, b int) int {
 	return a
 }
 
+func stripeSize(size int) int {
+	if size == 0 {
+		return BYTE_QUOTA
+	}
+	return size
+}
+
 type Demultiplexer struct {
-	Writers      []*os.File
+	Writers      []io.Writer
+	StripeSize   int
 	writerIndex  int
 	bytesWritten int
 }
@@ -34,7 +44,7 @@ func (d *Demultiplexer) Write(p []byte) (int, error) {
 	totalN := 0
 	for totalN < len(p) {
 		remainingBytes := len(p) - totalN
-		remainingBytesForWriter := BYTE_QUOTA - d.bytesWritten
+		remainingBytesForWriter := stripeSize(d.StripeSize) - d.bytesWritten
 		n, err := d.Writers[d.writerIndex].Write(p[totalN : totalN+min(remainingBytesForWriter, remainingBytes)])
 		d.bytesWritten += n
 		totalN += n
@@ -50,7 +60,8 @@ func (d *Demultiplexer) Write(p []byte) (int, error) {
 }
 
 type Multiplexer struct {
-	Readers     []*os.File
+	Readers     []io.Reader
+	StripeSize  int
 	readerIndex int
 	bytesRead   int
 }
@@ -67,7 +78,7 @@ func (m *Multiplexer) Read(p []byte) (int, error) {
 	totalN := 0
 	for totalN < len(p) {
 		remainingBytes := len(p) - totalN
-		remainingBytesForReader := BYTE_QUOTA - m.bytesRead
+		remainingBytesForReader := stripeSize(m.StripeSize) - m.bytesRead
 		buf := make([]byte, min(remainingBytes, remainingBytesForReader))
 		n, err := m.Readers[m.readerIndex].Read(buf)
 		p = append(p[0:totalN], buf[0:n]...)
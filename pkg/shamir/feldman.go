@@ -0,0 +1,217 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Feldman's verifiable secret sharing. Shares are points on a random
+// polynomial over the integers mod q, just like regular shamir shares, but
+// alongside them we publish a commitment to each of the polynomial's
+// coefficients: g^coefficient mod p. Anybody holding the commitments can check
+// that a share lies on the committed polynomial, which means a corrupted or
+// swapped share can be singled out rather than silently producing the wrong
+// secret.
+//
+// The commitments only hide the secret computationally: the first of them is
+// g^secret mod p, so anybody who could take discrete logarithms in the group,
+// or who could guess the secret, could check their guess against it. That's
+// fine for a random 256-bit key, which can't be guessed, but don't use this to
+// split a secret that could be.
+//
+// We work in the subgroup of prime order q = (p-1)/2 of the 2048-bit MODP
+// group from RFC 3526, where p is a safe prime. Because p = 7 mod 8, 2 is a
+// quadratic residue and so generates that subgroup.
+
+const feldmanPHex = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+// feldmanElementSize is the size in bytes of numbers mod p (and mod q)
+const feldmanElementSize = 256
+
+var (
+	feldmanP *big.Int
+	feldmanQ *big.Int
+	feldmanG = big.NewInt(2)
+)
+
+func init() {
+	feldmanP, _ = new(big.Int).SetString(feldmanPHex, 16)
+	feldmanQ = new(big.Int).Rsh(feldmanP, 1)
+}
+
+func encodeElement(n *big.Int) []byte {
+	out := make([]byte, feldmanElementSize)
+	b := n.Bytes()
+	copy(out[feldmanElementSize-len(b):], b)
+	return out
+}
+
+// SplitVerifiable is like Split, except that it also returns commitments to
+// the polynomial the shares lie on, against which each share can be checked
+// with VerifyShare. The commitments are the same for every share and are
+// stored alongside each share. They only hide the secret computationally (see
+// above), so the secret should be a random key, not something guessable.
+// The secret can be at most 254 bytes long.
+func SplitVerifiable(secret []byte, parts, threshold int) ([][]byte, [][]byte, error) {
+	// Sanity check the input
+	if parts < threshold {
+		return nil, nil, fmt.Errorf("parts cannot be less than threshold")
+	}
+	if parts > 255 {
+		return nil, nil, fmt.Errorf("parts cannot exceed 255")
+	}
+	if threshold < 2 {
+		return nil, nil, fmt.Errorf("threshold must be at least 2")
+	}
+	if len(secret) == 0 {
+		return nil, nil, fmt.Errorf("cannot split an empty secret")
+	}
+	if len(secret) > feldmanElementSize-2 {
+		return nil, nil, fmt.Errorf("secret cannot exceed %d bytes", feldmanElementSize-2)
+	}
+
+	// We prefix the secret with a one byte so that leading zeros survive the
+	// round trip through a big.Int
+	intercept := new(big.Int).SetBytes(append([]byte{1}, secret...))
+
+	coefficients := make([]*big.Int, threshold)
+	coefficients[0] = intercept
+	for i := 1; i < threshold; i++ {
+		coefficient, err := rand.Int(rand.Reader, feldmanQ)
+		if err != nil {
+			return nil, nil, err
+		}
+		coefficients[i] = coefficient
+	}
+
+	commitments := make([][]byte, threshold)
+	for i, coefficient := range coefficients {
+		commitments[i] = encodeElement(new(big.Int).Exp(feldmanG, coefficient, feldmanP))
+	}
+
+	// The representation of each share is {y, x} where y takes up
+	// feldmanElementSize bytes and x is a single byte.
+	shares := make([][]byte, parts)
+	for i := range shares {
+		x := big.NewInt(int64(i + 1))
+
+		// Horner's method
+		y := new(big.Int).Set(coefficients[threshold-1])
+		for j := threshold - 2; j >= 0; j-- {
+			y.Mul(y, x)
+			y.Add(y, coefficients[j])
+			y.Mod(y, feldmanQ)
+		}
+
+		shares[i] = append(encodeElement(y), uint8(i+1))
+	}
+
+	return shares, commitments, nil
+}
+
+func decodeShare(share []byte) (*big.Int, *big.Int, error) {
+	if len(share) != feldmanElementSize+1 {
+		return nil, nil, errors.New("share is the wrong length")
+	}
+	x := big.NewInt(int64(share[feldmanElementSize]))
+	if x.Sign() == 0 {
+		return nil, nil, errors.New("share has an x coordinate of zero")
+	}
+	y := new(big.Int).SetBytes(share[:feldmanElementSize])
+	if y.Cmp(feldmanQ) >= 0 {
+		return nil, nil, errors.New("share is out of range")
+	}
+	return x, y, nil
+}
+
+// VerifyShare returns an error if the share does not lie on the polynomial
+// committed to by the commitments returned alongside it by SplitVerifiable.
+func VerifyShare(share []byte, commitments [][]byte) error {
+	if len(commitments) < 2 {
+		return errors.New("at least two commitments are required")
+	}
+
+	x, y, err := decodeShare(share)
+	if err != nil {
+		return err
+	}
+
+	// g^y should equal the product of commitment_j^(x^j)
+	expected := new(big.Int).Exp(feldmanG, y, feldmanP)
+
+	actual := big.NewInt(1)
+	power := big.NewInt(1)
+	for _, commitment := range commitments {
+		if len(commitment) != feldmanElementSize {
+			return errors.New("commitment is the wrong length")
+		}
+		c := new(big.Int).SetBytes(commitment)
+		if c.Sign() == 0 || c.Cmp(feldmanP) >= 0 {
+			return errors.New("commitment is out of range")
+		}
+		actual.Mul(actual, new(big.Int).Exp(c, power, feldmanP))
+		actual.Mod(actual, feldmanP)
+		power.Mul(power, x)
+		power.Mod(power, feldmanQ)
+	}
+
+	if expected.Cmp(actual) != 0 {
+		return errors.New("share does not match the commitments")
+	}
+
+	return nil
+}
+
+// CombineVerifiable is used to reverse a SplitVerifiable and reconstruct a
+// secret once a `threshold` number of shares are available. It does not
+// verify the shares: use VerifyShare for that.
+func CombineVerifiable(shares [][]byte) ([]byte, error) {
+	// Verify enough parts provided
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("less than two parts cannot be used to reconstruct the secret")
+	}
+
+	xs := make([]*big.Int, len(shares))
+	ys := make([]*big.Int, len(shares))
+	checkMap := map[int64]bool{}
+	for i, share := range shares {
+		x, y, err := decodeShare(share)
+		if err != nil {
+			return nil, err
+		}
+		if checkMap[x.Int64()] {
+			return nil, fmt.Errorf("duplicate part detected")
+		}
+		checkMap[x.Int64()] = true
+		xs[i], ys[i] = x, y
+	}
+
+	// lagrange interpolation at zero, mod q
+	intercept := new(big.Int)
+	for i := range shares {
+		num := big.NewInt(1)
+		denom := big.NewInt(1)
+		for j := range shares {
+			if i == j {
+				continue
+			}
+			num.Mul(num, xs[j])
+			num.Mod(num, feldmanQ)
+			denom.Mul(denom, new(big.Int).Sub(xs[j], xs[i]))
+			denom.Mod(denom, feldmanQ)
+		}
+		term := new(big.Int).Mul(ys[i], num)
+		term.Mul(term, new(big.Int).ModInverse(denom, feldmanQ))
+		intercept.Add(intercept, term)
+		intercept.Mod(intercept, feldmanQ)
+	}
+
+	encoded := intercept.Bytes()
+	if len(encoded) < 2 || encoded[0] != 1 {
+		return nil, errors.New("shares do not combine into a valid secret")
+	}
+
+	return encoded[1:], nil
+}
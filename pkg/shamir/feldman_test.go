@@ -0,0 +1,119 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitVerifiableCombine(t *testing.T) {
+	// leading zeros have to survive the round trip
+	secret := append([]byte{0, 0}, bytes.Repeat([]byte{0xab}, 30)...)
+
+	shares, commitments, err := SplitVerifiable(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 || len(commitments) != 3 {
+		t.Fatalf("expected 5 shares and 3 commitments, got %d and %d", len(shares), len(commitments))
+	}
+
+	for i, share := range shares {
+		if err := VerifyShare(share, commitments); err != nil {
+			t.Errorf("share %d: %s", i, err)
+		}
+	}
+
+	// every choice of 3 shares, in any order, gives back the secret
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				combined, err := CombineVerifiable([][]byte{shares[k], shares[i], shares[j]})
+				if err != nil {
+					t.Errorf("shares %d, %d and %d: %s", i, j, k, err)
+					continue
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Errorf("shares %d, %d and %d: expected %x, got %x", i, j, k, secret, combined)
+				}
+			}
+		}
+	}
+
+	// too few shares don't
+	combined, err := CombineVerifiable(shares[:2])
+	if err == nil && bytes.Equal(combined, secret) {
+		t.Error("two shares gave back the secret with a threshold of 3")
+	}
+}
+
+func TestVerifyShareBadShare(t *testing.T) {
+	secret := []byte("secret")
+	shares, commitments, err := SplitVerifiable(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := append([]byte{}, shares[1]...)
+	bad[feldmanElementSize-1] ^= 1
+	if err := VerifyShare(bad, commitments); err == nil {
+		t.Error("expected a share with a flipped bit to fail verification")
+	}
+
+	combined, err := CombineVerifiable([][]byte{shares[0], bad})
+	if err == nil && bytes.Equal(combined, secret) {
+		t.Error("a bad share combined into the secret")
+	}
+
+	// a good share claiming to be another one
+	swapped := append([]byte{}, shares[0]...)
+	swapped[feldmanElementSize] = 3
+	if err := VerifyShare(swapped, commitments); err == nil {
+		t.Error("expected a share with the wrong x coordinate to fail verification")
+	}
+
+	// a share from another split of the same secret
+	otherShares, _, err := SplitVerifiable(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyShare(otherShares[0], commitments); err == nil {
+		t.Error("expected a share from another split to fail verification")
+	}
+
+	for _, malformed := range [][]byte{shares[0][:10], append(bytes.Repeat([]byte{0xff}, feldmanElementSize), 1), append(make([]byte, feldmanElementSize), 0)} {
+		if err := VerifyShare(malformed, commitments); err == nil {
+			t.Errorf("expected malformed share %x... to fail verification", malformed[:4])
+		}
+	}
+}
+
+func TestSplitVerifiableInvalid(t *testing.T) {
+	secret := []byte("secret")
+
+	if _, _, err := SplitVerifiable(secret, 2, 3); err == nil {
+		t.Error("expected an error with fewer parts than the threshold")
+	}
+	if _, _, err := SplitVerifiable(secret, 256, 2); err == nil {
+		t.Error("expected an error with more than 255 parts")
+	}
+	if _, _, err := SplitVerifiable(secret, 3, 1); err == nil {
+		t.Error("expected an error with a threshold of 1")
+	}
+	if _, _, err := SplitVerifiable(nil, 3, 2); err == nil {
+		t.Error("expected an error with an empty secret")
+	}
+	if _, _, err := SplitVerifiable(make([]byte, feldmanElementSize-1), 3, 2); err == nil {
+		t.Error("expected an error with a secret that's too long")
+	}
+
+	shares, _, err := SplitVerifiable(make([]byte, feldmanElementSize-2), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CombineVerifiable([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("expected an error combining a share with itself")
+	}
+	if _, err := CombineVerifiable(shares[:1]); err == nil {
+		t.Error("expected an error combining a single share")
+	}
+}
@@ -0,0 +1,67 @@
+package shamir
+
+import "fmt"
+
+// Interpolator evaluates, at a fixed x, the polynomials that pass through
+// samples taken at a fixed set of x coordinates. This is what Reed-Solomon
+// erasure coding boils down to: treat the bytes at the same offset in each of
+// k pieces of data as the values at x = 1..k of a polynomial of degree k-1,
+// evaluate that polynomial at further x values to get parity, and later
+// interpolate from any k of those values to recover whichever are missing.
+//
+// Because the x coordinates are fixed we can precompute each sample's lagrange
+// basis and turn the multiplication by it into a table lookup, which matters
+// when we're doing this for every byte of a large file.
+type Interpolator struct {
+	tables [][256]uint8
+}
+
+// NewInterpolator returns an Interpolator for samples at the given (distinct,
+// non-zero) x coordinates, evaluating at x.
+func NewInterpolator(xSamples []uint8, x uint8) (*Interpolator, error) {
+	checkMap := map[uint8]bool{}
+	for _, xSample := range xSamples {
+		if xSample == 0 {
+			return nil, fmt.Errorf("x coordinates must be non-zero")
+		}
+		if checkMap[xSample] {
+			return nil, fmt.Errorf("duplicate x coordinate detected")
+		}
+		checkMap[xSample] = true
+	}
+
+	tables := make([][256]uint8, len(xSamples))
+	for i := range xSamples {
+		var basis uint8 = 1
+		for j := range xSamples {
+			if i == j {
+				continue
+			}
+			num := add(x, xSamples[j])
+			denom := add(xSamples[i], xSamples[j])
+			basis = mult(basis, div(num, denom))
+		}
+
+		for y := range tables[i] {
+			tables[i][y] = mult(uint8(y), basis)
+		}
+	}
+
+	return &Interpolator{tables: tables}, nil
+}
+
+// Interpolate fills dst with the interpolated value for each offset, where
+// ySamples holds the samples for each x coordinate the Interpolator was made
+// with. Each slice in ySamples must be at least as long as dst.
+func (in *Interpolator) Interpolate(dst []byte, ySamples [][]byte) {
+	for i := range dst {
+		dst[i] = 0
+	}
+
+	for i, table := range in.tables {
+		samples := ySamples[i]
+		for j := range dst {
+			dst[j] = add(dst[j], table[samples[j]])
+		}
+	}
+}
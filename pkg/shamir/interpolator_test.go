@@ -0,0 +1,79 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInterpolator(t *testing.T) {
+	for degree := uint8(0); degree < 5; degree++ {
+		xSamples := []uint8{}
+		for x := uint8(1); x <= degree+1; x++ {
+			// spread the samples out so they aren't always 1..k
+			xSamples = append(xSamples, x*37)
+		}
+
+		// one polynomial per offset
+		polynomials := []polynomial{}
+		for offset := 0; offset < 8; offset++ {
+			p, err := makePolynomial(uint8(offset*11), degree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			polynomials = append(polynomials, p)
+		}
+
+		ySamples := make([][]byte, len(xSamples))
+		for i, x := range xSamples {
+			for _, p := range polynomials {
+				ySamples[i] = append(ySamples[i], p.evaluate(x))
+			}
+		}
+
+		for _, x := range []uint8{0, 1, xSamples[0], 200, 255} {
+			interpolator, err := NewInterpolator(xSamples, x)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := make([]byte, len(polynomials))
+			interpolator.Interpolate(dst, ySamples)
+
+			expected := []byte{}
+			for _, p := range polynomials {
+				expected = append(expected, p.evaluate(x))
+			}
+			if !bytes.Equal(dst, expected) {
+				t.Errorf("degree %d at x=%d: expected %v, got %v", degree, x, expected, dst)
+			}
+		}
+	}
+}
+
+func TestInterpolatorMatchesInterpolatePolynomial(t *testing.T) {
+	xSamples := []uint8{3, 9, 27}
+	ySamples := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+
+	interpolator, err := NewInterpolator(xSamples, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]byte, 3)
+	interpolator.Interpolate(dst, ySamples)
+
+	for offset := range dst {
+		ys := []uint8{ySamples[0][offset], ySamples[1][offset], ySamples[2][offset]}
+		if expected := interpolatePolynomial(xSamples, ys, 100); dst[offset] != expected {
+			t.Errorf("offset %d: expected %d, got %d", offset, expected, dst[offset])
+		}
+	}
+}
+
+func TestNewInterpolatorInvalidSamples(t *testing.T) {
+	if _, err := NewInterpolator([]uint8{1, 0}, 5); err == nil {
+		t.Error("expected an error for a zero x coordinate")
+	}
+	if _, err := NewInterpolator([]uint8{1, 2, 1}, 5); err == nil {
+		t.Error("expected an error for a duplicate x coordinate")
+	}
+}